@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/clementnuss/delpro-exporter/internal/models"
+)
+
+// redactedValue replaces the value of secret settings
+const redactedValue = "REDACTED"
+
+// envVarPrefix is the prefix of the environment variables setting flags
+const envVarPrefix = "DELPRO"
+
+// configSettings returns the effective value and source of every flag
+// A flag set but absent from the command line arguments was set through its environment variable when it is not
+// empty, environment variables taking precedence over the config file, and through the config file otherwise
+func configSettings(fs *flag.FlagSet, args []string) []models.ConfigSetting {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	fromArgs := argFlagNames(fs, args)
+
+	var settings []models.ConfigSetting
+	fs.VisitAll(func(f *flag.Flag) {
+		source := models.ConfigSourceDefault
+		switch {
+		case fromArgs[f.Name]:
+			source = models.ConfigSourceFlag
+		case set[f.Name] && os.Getenv(envVarName(f.Name)) != "":
+			source = models.ConfigSourceEnv
+		case set[f.Name]:
+			source = models.ConfigSourceFile
+		}
+
+		value := f.Value.String()
+		if isSecret(f.Name) {
+			value = redactedValue
+		}
+		settings = append(settings, models.ConfigSetting{Name: f.Name, Value: value, Source: source})
+	})
+
+	return settings
+}
+
+// envVarName returns the environment variable setting a flag, as derived by ff
+func envVarName(name string) string {
+	return envVarPrefix + "_" + strings.NewReplacer("-", "_", ".", "_", "/", "_").Replace(strings.ToUpper(name))
+}
+
+// argFlagNames returns the names of the flags present in command line arguments, following the flag package syntax
+func argFlagNames(fs *flag.FlagSet, args []string) map[string]bool {
+	names := make(map[string]bool)
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		names[name] = true
+
+		// Non boolean flags without `=` take the next argument as value
+		if f := fs.Lookup(name); f != nil && !hasValue && !isBoolFlag(f) {
+			i++
+		}
+	}
+	return names
+}
+
+// isBoolFlag reports whether a flag is a boolean flag, which takes no separate value argument
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// isSecret reports whether a flag holds a secret that must never be exposed
+func isSecret(name string) bool {
+	for _, word := range []string{"password", "token", "secret"} {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleConfig serves the effective configuration as JSON to clients presenting the bearer token
+// The database password is set through SQL_PASSWORD and is only listed as redacted
+func handleConfig(settings []models.ConfigSetting, token string) http.HandlerFunc {
+	settings = append(slices.Clone(settings), models.ConfigSetting{Name: "SQL_PASSWORD", Value: redactedValue, Source: models.ConfigSourceEnv})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(settings); err != nil {
+			log.Printf("Error writing configuration: %v", err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/clementnuss/delpro-exporter/internal/models"
+	"github.com/peterbourgon/ff/v3"
+)
+
+func TestConfigSettingsSources(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "delpro.conf")
+	if err := os.WriteFile(configFile, []byte("db-host filehost\ndb-name filedb\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("DELPRO_DB_NAME", "envdb")
+	t.Setenv("DELPRO_DB_PORT", "1434")
+
+	fs := flag.NewFlagSet("delpro-exporter", flag.ContinueOnError)
+	fs.String("config", "", "")
+	fs.String("db-host", "localhost", "")
+	fs.String("db-name", "DDM", "")
+	fs.String("db-port", "1433", "")
+	fs.String("db-user", "sa", "")
+	fs.String("listen-address", ":9090", "")
+
+	args := []string{"--config", configFile, "--listen-address=:9100"}
+	if err := ff.Parse(fs, args, ff.WithEnvVarPrefix(envVarPrefix), ff.WithConfigFileFlag("config"), ff.WithConfigFileParser(ff.PlainParser)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]models.ConfigSetting{
+		"config":         {Name: "config", Value: configFile, Source: models.ConfigSourceFlag},
+		"db-host":        {Name: "db-host", Value: "filehost", Source: models.ConfigSourceFile},
+		"db-name":        {Name: "db-name", Value: "envdb", Source: models.ConfigSourceEnv},
+		"db-port":        {Name: "db-port", Value: "1434", Source: models.ConfigSourceEnv},
+		"db-user":        {Name: "db-user", Value: "sa", Source: models.ConfigSourceDefault},
+		"listen-address": {Name: "listen-address", Value: ":9100", Source: models.ConfigSourceFlag},
+	}
+	for _, setting := range configSettings(fs, args) {
+		if setting != want[setting.Name] {
+			t.Errorf("setting = %+v, want %+v", setting, want[setting.Name])
+		}
+	}
+}
+
+func TestConfigNeverExposesSecrets(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "web-password")
+	if err := os.WriteFile(passwordFile, []byte("web-s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SQL_PASSWORD", "db-s3cret")
+
+	fs := flag.NewFlagSet("delpro-exporter", flag.ContinueOnError)
+	fs.String("db-user", "sa", "")
+	fs.String("web-auth-password-file", "", "")
+	fs.String("config-token", "", "")
+	args := []string{"--web-auth-password-file", passwordFile, "--config-token=tok-s3cret"}
+	if err := ff.Parse(fs, args, ff.WithEnvVarPrefix(envVarPrefix)); err != nil {
+		t.Fatal(err)
+	}
+	handler := handleConfig(configSettings(fs, args), "tok-s3cret")
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/config", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status without token = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	req := httptest.NewRequest("GET", "/config", nil)
+	req.Header.Set("Authorization", "Bearer tok-s3cret")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	for _, secret := range []string{"db-s3cret", "web-s3cret", "tok-s3cret", passwordFile} {
+		if strings.Contains(rec.Body.String(), secret) {
+			t.Errorf("configuration exposes %q:\n%s", secret, rec.Body.String())
+		}
+	}
+
+	var settings []models.ConfigSetting
+	if err := json.Unmarshal(rec.Body.Bytes(), &settings); err != nil {
+		t.Fatal(err)
+	}
+	redacted := make(map[string]bool)
+	for _, setting := range settings {
+		redacted[setting.Name] = setting.Value == redactedValue
+	}
+	if want := map[string]bool{"db-user": false, "web-auth-password-file": true, "config-token": true, "SQL_PASSWORD": true}; !maps.Equal(redacted, want) {
+		t.Errorf("redacted settings = %v, want %v", redacted, want)
+	}
+}
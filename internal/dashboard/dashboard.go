@@ -0,0 +1,132 @@
+package dashboard
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/clementnuss/delpro-exporter/internal/models"
+)
+
+const (
+	// Panel layout on the 24 columns Grafana grid
+	panelWidth  = 12
+	panelHeight = 8
+)
+
+// Dashboard is a minimal Grafana dashboard JSON model
+type Dashboard struct {
+	UID           string     `json:"uid"`
+	Title         string     `json:"title"`
+	Tags          []string   `json:"tags"`
+	SchemaVersion int        `json:"schemaVersion"`
+	Time          TimeRange  `json:"time"`
+	Templating    Templating `json:"templating"`
+	Panels        []Panel    `json:"panels"`
+}
+
+// TimeRange is the default time range of the dashboard
+type TimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Templating holds the dashboard variables
+type Templating struct {
+	List []Variable `json:"list"`
+}
+
+// Variable is a dashboard template variable
+type Variable struct {
+	Name  string `json:"name"`
+	Label string `json:"label"`
+	Type  string `json:"type"`
+	Query string `json:"query"`
+}
+
+// Datasource references the datasource used by a panel
+type Datasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+// GridPos is the position of a panel on the dashboard grid
+type GridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// Target is a Prometheus query of a panel
+type Target struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+}
+
+// Panel is a Grafana time series panel
+type Panel struct {
+	ID          int        `json:"id"`
+	Type        string     `json:"type"`
+	Title       string     `json:"title"`
+	Description string     `json:"description"`
+	Datasource  Datasource `json:"datasource"`
+	GridPos     GridPos    `json:"gridPos"`
+	Targets     []Target   `json:"targets"`
+}
+
+// New builds a dashboard with one panel per metric descriptor, metrics being named as exposed with naming
+func New(descriptors []models.MetricDescriptor, naming models.Naming) *Dashboard {
+	d := &Dashboard{
+		UID:           "delpro-exporter",
+		Title:         "DelPro Exporter",
+		Tags:          []string{"delpro"},
+		SchemaVersion: 39,
+		Time:          TimeRange{From: "now-7d", To: "now"},
+		Templating: Templating{List: []Variable{
+			{Name: "datasource", Label: "Datasource", Type: "datasource", Query: "prometheus"},
+		}},
+	}
+
+	for i, desc := range descriptors {
+		d.Panels = append(d.Panels, Panel{
+			ID:          i + 1,
+			Type:        "timeseries",
+			Title:       desc.Help,
+			Description: naming.MetricFamily(desc.Name),
+			Datasource:  Datasource{Type: "prometheus", UID: "${datasource}"},
+			GridPos: GridPos{
+				H: panelHeight,
+				W: panelWidth,
+				X: (i % 2) * panelWidth,
+				Y: (i / 2) * panelHeight,
+			},
+			Targets: []Target{{RefID: "A", Expr: panelExpr(desc, naming)}},
+		})
+	}
+
+	return d
+}
+
+// Write writes the dashboard built from the metric descriptor registry as JSON
+func Write(w io.Writer, naming models.Naming) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(New(models.MetricDescriptors, naming))
+}
+
+// panelExpr returns the PromQL expression used to plot a metric based on its type
+// Teat metrics are plotted under the configured teat metric prefix, as exposed
+func panelExpr(desc models.MetricDescriptor, naming models.Naming) string {
+	name := naming.MetricFamily(desc.Name)
+	switch desc.Type {
+	case models.MetricTypeCounter:
+		return fmt.Sprintf("increase(%s[1d])", name)
+	case models.MetricTypeHistogram:
+		// Average value over the last day
+		return fmt.Sprintf("rate(%s_sum[1d]) / rate(%s_count[1d])", name, name)
+	default:
+		return name
+	}
+}
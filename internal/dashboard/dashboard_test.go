@@ -0,0 +1,54 @@
+package dashboard
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/clementnuss/delpro-exporter/internal/models"
+)
+
+func TestWrite(t *testing.T) {
+	var out bytes.Buffer
+	if err := Write(&out, models.Naming{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var d Dashboard
+	if err := json.Unmarshal(out.Bytes(), &d); err != nil {
+		t.Fatalf("invalid dashboard JSON: %v", err)
+	}
+	if len(d.Panels) != len(models.MetricDescriptors) {
+		t.Fatalf("got %d panels, want one per registered metric (%d)", len(d.Panels), len(models.MetricDescriptors))
+	}
+
+	for _, desc := range models.MetricDescriptors {
+		found := false
+		for _, panel := range d.Panels {
+			if panel.Description == desc.Name && len(panel.Targets) == 1 && strings.Contains(panel.Targets[0].Expr, desc.Name) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("no panel plots %s", desc.Name)
+		}
+	}
+}
+
+func TestPanelExpr(t *testing.T) {
+	tests := []struct {
+		desc models.MetricDescriptor
+		want string
+	}{
+		{models.MetricDescriptor{Name: models.MetricMilkSessions, Type: models.MetricTypeCounter}, "increase(delpro_milk_sessions_total[1d])"},
+		{models.MetricDescriptor{Name: "delpro_milk_duration_seconds", Type: models.MetricTypeHistogram}, "rate(delpro_milk_duration_seconds_sum[1d]) / rate(delpro_milk_duration_seconds_count[1d])"},
+		{models.MetricDescriptor{Name: "delpro_milk_yield_liters", Type: models.MetricTypeGauge}, "delpro_milk_yield_liters"},
+	}
+	for _, tt := range tests {
+		if got := panelExpr(tt.desc, models.Naming{}); got != tt.want {
+			t.Errorf("panelExpr(%s) = %q, want %q", tt.desc.Name, got, tt.want)
+		}
+	}
+}
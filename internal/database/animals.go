@@ -0,0 +1,67 @@
+package database
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// AnimalRange is an inclusive range of animal numbers, a single animal when First equals Last
+type AnimalRange struct {
+	First int64
+	Last  int64
+}
+
+// ParseAnimalRanges parses comma separated animal numbers or ranges, e.g. `9000-9999,42`
+func ParseAnimalRanges(expr string) ([]AnimalRange, error) {
+	var ranges []AnimalRange
+	if strings.TrimSpace(expr) == "" {
+		return ranges, nil
+	}
+
+	for _, item := range strings.Split(expr, ",") {
+		item = strings.TrimSpace(item)
+		firstStr, lastStr, isRange := strings.Cut(item, "-")
+		if !isRange {
+			lastStr = firstStr
+		}
+
+		first, err := strconv.ParseInt(strings.TrimSpace(firstStr), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid animal number %q", item)
+		}
+		last, err := strconv.ParseInt(strings.TrimSpace(lastStr), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid animal number %q", item)
+		}
+		if first > last {
+			return nil, fmt.Errorf("invalid animal range %q, the first number must not exceed the last", item)
+		}
+		ranges = append(ranges, AnimalRange{First: first, Last: last})
+	}
+
+	return ranges, nil
+}
+
+// containsAnimal reports whether an animal number is in any of the ranges
+func containsAnimal(ranges []AnimalRange, animalNumber string) bool {
+	number, err := strconv.ParseInt(animalNumber, 10, 64)
+	if err != nil {
+		return false
+	}
+	for _, r := range ranges {
+		if number >= r.First && number <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+// animalSelected reports whether an animal is kept in metrics
+// Exclusion takes precedence, so an animal both included and excluded is left out
+func (c *Client) animalSelected(animalNumber string) bool {
+	if containsAnimal(c.excludeAnimals, animalNumber) {
+		return false
+	}
+	return len(c.includeAnimals) == 0 || containsAnimal(c.includeAnimals, animalNumber)
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+)
+
+// DefaultBreedLocale is the locale of breed names when none is configured
+const DefaultBreedLocale = "fr"
+
+// builtinBreedTranslations maps the English DelPro breed names to their local names, per locale
+// Locales without translations, such as en, keep the DelPro names
+var builtinBreedTranslations = map[string]map[string]string{
+	"en": {},
+	"fr": {
+		"Holstein Friesian":     "Holstein",
+		"Montbeliard":           "Montbéliarde",
+		"Swedish Red-and-White": "Rouge Suédoise",
+		"Cross Breed":           "Croisée",
+		"Unknown Breed":         "Race Inconnue",
+	},
+	"de": {
+		"Holstein Friesian":     "Holstein",
+		"Montbeliard":           "Montbéliarde",
+		"Swedish Red-and-White": "Schwedisches Rotvieh",
+		"Cross Breed":           "Kreuzung",
+		"Unknown Breed":         "Unbekannte Rasse",
+	},
+}
+
+// LoadBreedTranslations returns the breed translations of a locale, the built-in ones completed by those of path when set
+// The file is a JSON object of locales to translations, e.g. `{"de": {"Holstein Friesian": "Deutsche Holstein"}}`
+func LoadBreedTranslations(locale, path string) (map[string]string, error) {
+	translations := maps.Clone(builtinBreedTranslations[locale])
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read breed translations: %w", err)
+		}
+		var locales map[string]map[string]string
+		if err := json.Unmarshal(data, &locales); err != nil {
+			return nil, fmt.Errorf("failed to parse breed translations %s: %w", path, err)
+		}
+		if custom, exists := locales[locale]; exists {
+			if translations == nil {
+				translations = make(map[string]string, len(custom))
+			}
+			for breed, name := range custom {
+				// Translations end up in label values, like names read from the database
+				translations[breed] = cleanLabelValue(name)
+			}
+		}
+	}
+
+	if translations == nil {
+		return nil, fmt.Errorf("no breed translations for locale %q", locale)
+	}
+	return translations, nil
+}
+
+// translateBreed converts an English breed name to the configured locale, unknown breeds are returned unchanged
+func (c *Client) translateBreed(breed string) string {
+	if name, exists := c.breedTranslations[breed]; exists {
+		return name
+	}
+	return breed
+}
@@ -1,40 +1,157 @@
 package database
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/VictoriaMetrics/metrics"
 	"github.com/clementnuss/delpro-exporter/internal/models"
 	_ "github.com/microsoft/go-mssqldb"
 )
 
+// Config holds the database connection settings
+type Config struct {
+	Host         string
+	Port         string
+	Name         string
+	User         string
+	Password     string
+	Location     *time.Location // Database timezone location
+	DeviceFilter int64          // Restrict queries to a single milking device (0 means all devices)
+	NumberWidth  int            // VARCHAR width used when casting animal numbers
+	ExtraFilters []Filter       // Additional conditions applied to the milking records query
+	Metrics      *metrics.Set   // Metric set receiving database metrics, the default set when nil
+
+	PrometheusHistogram bool // Record query durations with Prometheus le buckets instead of vmrange buckets
+	VersionLabel        bool // Add the data_format_version label to database metrics
+
+	Encrypt                string // Connection encryption mode, one of disable, true or strict (disable when empty)
+	TrustServerCertificate bool   // Accept self-signed server certificates when encryption is enabled
+
+	AppName     string     // Application name identifying the exporter sessions on the server, DefaultAppName when empty
+	ExtraParams url.Values // Additional connection string parameters, e.g. packet size or app name
+
+	ConnectRetries int           // Connection attempts before NewClient fails, DefaultConnectRetries when 0
+	ConnectBackoff time.Duration // Wait before the second attempt, growing linearly, DefaultConnectBackoff when 0
+
+	// BreedTranslations maps DelPro breed names to the names exposed in the breed label, unknown breeds are kept
+	// The French translations are used when nil
+	BreedTranslations map[string]string
+
+	ExcludeCurrentHour bool          // Exclude the in-progress hour from device utilization
+	ExcludeAnimals     []AnimalRange // Animals left out of all metrics, e.g. test or reference animals
+	IncludeAnimals     []AnimalRange // Only animals kept in metrics when set, excluded animals are still left out
+}
+
+// Connection encryption modes
+const (
+	EncryptDisable = "disable" // No encryption, not even for the login packet
+	EncryptTrue    = "true"    // Encrypted connection
+	EncryptStrict  = "strict"  // TDS 8.0 strict encryption, the server certificate is always validated
+)
+
+// ParseEncrypt parses a connection encryption mode
+func ParseEncrypt(mode string) (string, error) {
+	switch mode {
+	case EncryptDisable, EncryptTrue, EncryptStrict:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid encryption mode %q, use disable, true or strict", mode)
+	}
+}
+
+// securityParams are connection string parameters that extra parameters may not set, as they control
+// authentication and encryption, which are configured by dedicated settings
+var securityParams = map[string]bool{
+	"encrypt":                true,
+	"trustservercertificate": true,
+	"certificate":            true,
+	"hostnameincertificate":  true,
+	"servercertificate":      true,
+	"tlsmin":                 true,
+	"user id":                true,
+	"password":               true,
+}
+
+// ParseExtraParams parses semicolon separated `key=value` connection string parameters, e.g. `packet size=4096;app name=delpro`
+// Keys are case insensitive, parameters controlling authentication or encryption are rejected
+func ParseExtraParams(expr string) (url.Values, error) {
+	params := url.Values{}
+	for pair := range strings.SplitSeq(expr, ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, found := strings.Cut(pair, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid connection parameter %q, use key=value", pair)
+		}
+		if securityParams[key] {
+			return nil, fmt.Errorf("connection parameter %q cannot be overridden, use the dedicated setting", key)
+		}
+		params.Set(key, strings.TrimSpace(value))
+	}
+	return params, nil
+}
+
+// DefaultAppName is the default application name of the exporter database sessions
+const DefaultAppName = "delpro-exporter"
+
+// DefaultNumberWidth is the default VARCHAR width of animal numbers, wide enough for any BIGINT
+const DefaultNumberWidth = 20
+
+// Default connection retry settings
+const (
+	DefaultConnectRetries = 3
+	DefaultConnectBackoff = 2 * time.Second
+)
+
 // Client handles database connections and operations
 type Client struct {
-	db         *sql.DB
-	dbLocation *time.Location
+	db           *sql.DB
+	dbLocation   *time.Location
+	deviceFilter int64
+	numberWidth  int
+	extraFilters []Filter
+	metrics      *metrics.Set
+
+	excludeCurrentHour bool
+	excludeAnimals     []AnimalRange
+	includeAnimals     []AnimalRange
+
+	breedTranslations   map[string]string
+	prometheusHistogram bool
+	naming              models.Naming
+
+	missingColumns map[string]bool // Optional columns missing from this DelPro version, by query expression
 }
 
-// NewClient creates a new database client instance
-func NewClient(host, port, dbname, user, password string, dbLocation *time.Location) *Client {
-	// Add explicit timeout parameters and packet size limit for MTU issues
-	connString := fmt.Sprintf("server=%s;port=%s;database=%s;user id=%s;password=%s;encrypt=disable;connection timeout=10;dial timeout=10",
-		host, port, dbname, user, password)
+// NewClient creates a new database client instance, retrying the connection with a linear backoff
+// An error is returned when the database is still unreachable after all attempts
+func NewClient(cfg Config) (*Client, error) {
+	connString := connectionString(cfg)
 
-	log.Printf("Attempting to connect to database at %s:%s", host, port)
+	retries := cmp.Or(max(cfg.ConnectRetries, 0), DefaultConnectRetries)
+	backoff := cmp.Or(cfg.ConnectBackoff, DefaultConnectBackoff)
 
-	// Test network connectivity first
-	if !testNetworkConnectivity(host, port) {
-		log.Fatal("Network connectivity test failed")
+	log.Printf("Attempting to connect to database at %s:%s", cfg.Host, cfg.Port)
+	if cfg.DeviceFilter > 0 {
+		log.Printf("Restricting collection to milking device %d", cfg.DeviceFilter)
 	}
 
 	db, err := sql.Open("sqlserver", connString)
 	if err != nil {
-		log.Fatal("Failed to create database connection:", err)
+		return nil, fmt.Errorf("failed to create database connection: %w", err)
 	}
 
 	// Set connection pool timeouts
@@ -42,50 +159,216 @@ func NewClient(host, port, dbname, user, password string, dbLocation *time.Locat
 	db.SetMaxOpenConns(10)
 	db.SetMaxIdleConns(10)
 
-	// Try to ping with multiple retries
-	const maxRetries = 3
-	for i := range maxRetries {
-		log.Printf("Database ping attempt %d/%d", i+1, maxRetries)
+	client := NewClientWithDB(db, cfg)
+	for i := range retries {
+		log.Printf("Database connection attempt %d/%d", i+1, retries)
 
-		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-		err := db.PingContext(ctx)
-		cancel()
+		// Test network connectivity first
+		err = testNetworkConnectivity(cfg.Host, cfg.Port)
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			err = db.PingContext(ctx)
+			if err == nil {
+				err = client.detectOptionalColumns(ctx)
+			}
+			cancel()
+		}
 
 		if err == nil {
 			log.Printf("Database connection successful")
-			return &Client{db: db, dbLocation: dbLocation}
+			return client, nil
 		}
 
-		log.Printf("Database ping failed (attempt %d/%d): %v", i+1, maxRetries, err)
+		log.Printf("Database connection failed (attempt %d/%d): %v", i+1, retries, err)
 
-		if i < maxRetries-1 {
-			time.Sleep(time.Duration(i+1) * 2 * time.Second) // Exponential backoff
+		if i < retries-1 {
+			time.Sleep(time.Duration(i+1) * backoff) // Linear backoff
 		}
 	}
 
-	log.Fatal("Failed to connect to database after all retries")
+	db.Close()
+	return nil, fmt.Errorf("failed to connect to database after %d attempts: %w", retries, err)
+}
+
+// NewClientWithDB creates a new database client using an already opened database handle, which the client then owns
+// The connection settings of cfg are ignored
+func NewClientWithDB(db *sql.DB, cfg Config) *Client {
+	if cfg.NumberWidth <= 0 {
+		cfg.NumberWidth = DefaultNumberWidth
+	}
+	if cfg.BreedTranslations == nil {
+		cfg.BreedTranslations = builtinBreedTranslations[DefaultBreedLocale]
+	}
+
+	return &Client{
+		db:           db,
+		dbLocation:   cfg.Location,
+		deviceFilter: cfg.DeviceFilter,
+		numberWidth:  cfg.NumberWidth,
+		extraFilters: cfg.ExtraFilters,
+		metrics:      cmp.Or(cfg.Metrics, metrics.GetDefaultSet()),
+
+		excludeCurrentHour: cfg.ExcludeCurrentHour,
+		excludeAnimals:     cfg.ExcludeAnimals,
+		includeAnimals:     cfg.IncludeAnimals,
+
+		breedTranslations:   cfg.BreedTranslations,
+		prometheusHistogram: cfg.PrometheusHistogram,
+		naming:              models.Naming{VersionLabel: cfg.VersionLabel},
+	}
+}
+
+// optionalColumn is a column of the milking records query missing from some DelPro versions
+type optionalColumn struct {
+	table  string
+	column string
+	expr   string // Expression selecting the column in milkingRecordsQuery, replaced by NULL when missing
+}
+
+// optionalColumns are the milking records query columns that are detected on connection
+var optionalColumns = []optionalColumn{
+	{"VoluntarySessionMilkYield", "ManualAttach", "vmy.ManualAttach"},
+	{"VoluntarySessionMilkYield", "YieldLF", "vmy.YieldLF"},
+	{"VoluntarySessionMilkYield", "YieldRF", "vmy.YieldRF"},
+	{"VoluntarySessionMilkYield", "YieldLR", "vmy.YieldLR"},
+	{"VoluntarySessionMilkYield", "YieldRR", "vmy.YieldRR"},
+	{"VoluntarySessionMilkYield", "PeakFlowLF", "vmy.PeakFlowLF"},
+	{"VoluntarySessionMilkYield", "PeakFlowRF", "vmy.PeakFlowRF"},
+	{"VoluntarySessionMilkYield", "PeakFlowLR", "vmy.PeakFlowLR"},
+	{"VoluntarySessionMilkYield", "PeakFlowRR", "vmy.PeakFlowRR"},
+	{"SessionMilkYield", "AvgTemperature", "smy.AvgTemperature"},
+}
+
+// detectOptionalColumns checks which optional columns the database has, like GetWeightRecords checks for its table
+// Columns are assumed present until checked
+func (c *Client) detectOptionalColumns(ctx context.Context) error {
+	missing := make(map[string]bool)
+	for _, col := range optionalColumns {
+		var exists bool
+		if err := c.db.QueryRowContext(ctx, `SELECT CAST(CASE WHEN COL_LENGTH(@Table, @Column) IS NULL THEN 0 ELSE 1 END AS BIT)`,
+			sql.Named("Table", col.table), sql.Named("Column", col.column)).Scan(&exists); err != nil {
+			return fmt.Errorf("failed to check column %s.%s: %w", col.table, col.column, err)
+		}
+		if !exists {
+			log.Printf("No %s.%s column, it is read as NULL", col.table, col.column)
+			missing[col.expr] = true
+		}
+	}
+	c.missingColumns = missing
 	return nil
 }
 
+// connectionString builds the sqlserver:// URL connection string for the given configuration
+// Using url.URL ensures special characters in any field are escaped correctly
+func connectionString(cfg Config) string {
+	// Add explicit timeout parameters and packet size limit for MTU issues
+	query := url.Values{}
+	query.Set("database", cfg.Name)
+	encrypt := cmp.Or(cfg.Encrypt, EncryptDisable)
+	query.Set("encrypt", encrypt)
+	if encrypt != EncryptDisable && cfg.TrustServerCertificate {
+		query.Set("TrustServerCertificate", "true")
+	}
+	query.Set("connection timeout", "10")
+	query.Set("dial timeout", "10")
+	query.Set("app name", cmp.Or(cfg.AppName, DefaultAppName))
+
+	// Extra parameters may override the defaults above, security parameters are rejected when parsing them
+	for key, values := range cfg.ExtraParams {
+		query[key] = values
+	}
+
+	u := &url.URL{
+		Scheme:   "sqlserver",
+		User:     url.UserPassword(cfg.User, cfg.Password),
+		Host:     net.JoinHostPort(cfg.Host, cfg.Port),
+		RawQuery: query.Encode(),
+	}
+	return u.String()
+}
+
+// Filter is an additional numeric condition on the milking records query
+type Filter struct {
+	Field    string  // Filter field, one of the filterColumns keys
+	Operator string  // SQL comparison operator
+	Value    float64 // Value compared against, passed as a query parameter
+}
+
+// filterColumns maps the fields allowed in filters to their SQL expression
+var filterColumns = map[string]string{
+	"animal_number": "ba.Number",
+	"device":        "smy.MilkingDevice",
+	"yield":         "smy.TotalYield",
+	"duration":      "DATEDIFF(SECOND, smy.BeginTime, smy.EndTime)",
+}
+
+// filterOperators maps the operators allowed in filters to their SQL operator
+var filterOperators = map[string]string{
+	"=":  "=",
+	"!=": "<>",
+	"<":  "<",
+	"<=": "<=",
+	">":  ">",
+	">=": ">=",
+}
+
+// filterPattern matches a single `field operator value` condition
+var filterPattern = regexp.MustCompile(`^\s*([a-z_]+)\s*(<=|>=|!=|=|<|>)\s*(-?[0-9]+(?:\.[0-9]+)?)\s*$`)
+
+// ParseFilters parses comma separated `field operator value` conditions, e.g. `animal_number<9000,yield>0`
+// Only known fields, comparison operators and numeric values are accepted to prevent SQL injection
+func ParseFilters(expr string) ([]Filter, error) {
+	var filters []Filter
+	if strings.TrimSpace(expr) == "" {
+		return filters, nil
+	}
+
+	for _, cond := range strings.Split(expr, ",") {
+		m := filterPattern.FindStringSubmatch(cond)
+		if m == nil {
+			return nil, fmt.Errorf("invalid filter condition %q, expected `field operator number`", cond)
+		}
+		if _, ok := filterColumns[m[1]]; !ok {
+			return nil, fmt.Errorf("unknown filter field %q", m[1])
+		}
+		value, err := strconv.ParseFloat(m[3], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter value %q: %w", m[3], err)
+		}
+		filters = append(filters, Filter{Field: m[1], Operator: filterOperators[m[2]], Value: value})
+	}
+
+	return filters, nil
+}
+
 // Close closes the database connection
 func (c *Client) Close() error {
 	return c.db.Close()
 }
 
+// Ping verifies that the database is reachable
+func (c *Client) Ping(ctx context.Context) error {
+	return c.db.PingContext(ctx)
+}
+
+// Stats returns the database connection pool statistics
+func (c *Client) Stats() sql.DBStats {
+	return c.db.Stats()
+}
+
 // testNetworkConnectivity tests basic TCP connectivity to the database
-func testNetworkConnectivity(host, port string) bool {
+func testNetworkConnectivity(host, port string) error {
 	log.Printf("Testing network connectivity to %s:%s", host, port)
 
 	timeout := 10 * time.Second
 	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
 	if err != nil {
-		log.Printf("Network connectivity test failed: %v", err)
-		return false
+		return fmt.Errorf("network connectivity test failed: %w", err)
 	}
 
 	conn.Close()
 	log.Printf("Network connectivity test successful")
-	return true
+	return nil
 }
 
 // convertToDBTime converts a UTC time to database timezone for queries
@@ -104,33 +387,34 @@ func (c *Client) convertFromDBTime(t time.Time) time.Time {
 	return t.Add(-time.Duration(offset) * time.Second)
 }
 
-// GetMilkingRecords retrieves milking records from the database for the specified duration
-func (c *Client) GetMilkingRecords(ctx context.Context, start, end time.Time, lastOID int64) ([]*models.MilkingRecord, error) {
-	return c.GetMilkingRecordsWithOIDRange(ctx, start, end, lastOID, 0)
-}
+// overflowNumber is how SQL Server renders an integer too wide for the VARCHAR it is cast to
+const overflowNumber = "*"
 
-// GetMilkingRecordsWithOIDRange retrieves milking records from the database for the specified duration and OID range
-func (c *Client) GetMilkingRecordsWithOIDRange(ctx context.Context, start, end time.Time, startOID, endOID int64) ([]*models.MilkingRecord, error) {
-	// Convert query times to database timezone
-	dbStart := c.convertToDBTime(start)
-	dbEnd := c.convertToDBTime(end)
-	query := `
+// milkingRecordsQuery is the milking records query template, %d is the animal number width
+// The expressions of optionalColumns are replaced by NULL when the database lacks their column
+const milkingRecordsQuery = `
 		SELECT 
 			smy.OID,
-			CAST(ba.Number AS VARCHAR(10)) as animal_number,
+			CAST(ba.Number AS VARCHAR(%d)) as animal_number,
 			COALESCE(ba.Name, 'Unknown') as animal_name,
 			COALESCE(ba.OfficialRegNo, 'Unknown') as animal_reg_no,
 			COALESCE(tli.ItemValue, CAST(ba.Breed AS VARCHAR(10))) as breed_name,
+			COALESCE(CAST(ba.Breed AS VARCHAR(10)), 'unknown') as breed_id,
 			CAST(smy.MilkingDevice AS VARCHAR(10)) as device_id,
 			COALESCE(md.Name, 'Unknown') as destination_name,
 			als.LactationNumber as lactation_number,
 			DATEDIFF(day, als.StartDate, smy.EndTime) as days_in_lactation,
+			als.TotalYield as lactation_yield,
 			smy.TotalYield,
 			smy.AvgConductivity,
+			smy.AvgTemperature,
 			DATEDIFF(SECOND, smy.BeginTime, smy.EndTime) as duration_seconds,
 			vmy.Occ as somatic_cell_count,
 			vmy.Incomplete as incomplete,
 			vmy.Kickoff as kickoff,
+			vmy.ManualAttach as manual_attach,
+			vmy.YieldLF, vmy.YieldRF, vmy.YieldLR, vmy.YieldRR,
+			vmy.PeakFlowLF, vmy.PeakFlowRF, vmy.PeakFlowLR, vmy.PeakFlowRR,
 			smy.BeginTime,
 			smy.EndTime
 		FROM SessionMilkYield smy
@@ -138,111 +422,494 @@ func (c *Client) GetMilkingRecordsWithOIDRange(ctx context.Context, start, end t
 		LEFT JOIN TextLookupItem tli ON ba.Breed = tli.ItemID AND tli.Collection = 6
 		LEFT JOIN VoluntarySessionMilkYield vmy ON smy.OID = vmy.OID
 		LEFT JOIN MilkDestination md ON smy.Destination = md.OID
-		LEFT JOIN AnimalLactationSummary als ON ba.OID = als.Animal AND als.EndDate IS NULL
+		-- Pick the most recent open lactation so that lactation data stays deterministic
+		OUTER APPLY (
+			SELECT TOP 1 LactationNumber, StartDate, TotalYield
+			FROM AnimalLactationSummary
+			WHERE Animal = ba.OID AND EndDate IS NULL
+			ORDER BY StartDate DESC, OID DESC
+		) als
 		WHERE smy.EndTime >= @StartTime AND smy.EndTime < @EndTime
 		AND smy.OID > @StartOID
 		AND smy.TotalYield IS NOT NULL
 		AND ba.Number IS NOT NULL`
 
+// lactatingAnimalsQuery is the query template of animals with an open lactation and their last session of it
+const lactatingAnimalsQuery = `
+		SELECT
+			CAST(ba.Number AS VARCHAR(%d)) as animal_number,
+			COALESCE(ba.Name, 'Unknown') as animal_name,
+			COALESCE(ba.OfficialRegNo, 'Unknown') as animal_reg_no,
+			(
+				SELECT MAX(smy.EndTime)
+				FROM SessionMilkYield smy
+				WHERE smy.BasicAnimal = ba.OID AND smy.EndTime >= als.StartDate
+			) as last_session
+		FROM BasicAnimal ba
+		CROSS APPLY (
+			SELECT TOP 1 StartDate
+			FROM AnimalLactationSummary
+			WHERE Animal = ba.OID AND EndDate IS NULL
+			ORDER BY StartDate DESC, OID DESC
+		) als
+		WHERE ba.Number IS NOT NULL`
+
+// weightTable is the table holding walk-over scale weighings, only present on DelPro setups with scales
+const weightTable = "AnimalWeight"
+
+// weightRecordsQuery is the query template of the latest weighing of each animal within a time window
+const weightRecordsQuery = `
+		SELECT
+			CAST(ba.Number AS VARCHAR(%d)) as animal_number,
+			COALESCE(ba.Name, 'Unknown') as animal_name,
+			COALESCE(ba.OfficialRegNo, 'Unknown') as animal_reg_no,
+			aw.Weight,
+			aw.WeighingTime
+		FROM BasicAnimal ba
+		CROSS APPLY (
+			SELECT TOP 1 Weight, WeighingTime
+			FROM ` + weightTable + `
+			WHERE Animal = ba.OID AND WeighingTime >= @StartTime AND WeighingTime < @EndTime AND Weight IS NOT NULL
+			ORDER BY WeighingTime DESC, OID DESC
+		) aw
+		WHERE ba.Number IS NOT NULL`
+
+// deviceUtilizationQuery is the device utilization query template
+const deviceUtilizationQuery = `
+		SELECT 
+			CAST(smy.MilkingDevice AS VARCHAR(10)) as device_id,
+			COUNT(*) as session_count,
+			SUM(CASE WHEN vmy.Incomplete <> 0 THEN 1 ELSE 0 END) as incomplete_count
+		FROM SessionMilkYield smy
+		LEFT JOIN VoluntarySessionMilkYield vmy ON smy.OID = vmy.OID
+		WHERE smy.BeginTime >= @StartTime AND smy.BeginTime < @EndTime
+		AND smy.TotalYield IS NOT NULL`
+
+// Query is a named SQL query run by the client
+type Query struct {
+	Name string
+	SQL  string
+}
+
+// Queries returns the SQL queries run by the client with their parameter placeholders, including optional conditions
+func (c *Client) Queries() []Query {
+	milking, _ := c.milkingRecordsQuery(time.Time{}, time.Time{}, 0, 1, 0)
+	utilization, _ := c.deviceUtilizationQuery(time.Time{}, time.Time{})
+	return []Query{
+		{Name: "milking_records", SQL: milking},
+		{Name: "device_utilization", SQL: utilization},
+		{Name: "lactating_animals", SQL: fmt.Sprintf(lactatingAnimalsQuery, c.numberWidth)},
+		{Name: "weight_records", SQL: fmt.Sprintf(weightRecordsQuery, c.numberWidth)},
+	}
+}
+
+// milkingRecordsQuery builds the milking records query and its named parameters, returning at most limit
+// records of the lowest OIDs when limit is positive
+func (c *Client) milkingRecordsQuery(dbStart, dbEnd time.Time, startOID, endOID int64, limit int) (string, []any) {
+	query := fmt.Sprintf(milkingRecordsQuery, c.numberWidth)
+	for _, col := range optionalColumns {
+		if c.missingColumns[col.expr] {
+			query = strings.ReplaceAll(query, col.expr, "NULL")
+		}
+	}
+
 	// Add optional end OID condition
 	var params []any
 	params = append(params, sql.Named("StartTime", dbStart), sql.Named("EndTime", dbEnd), sql.Named("StartOID", startOID))
 
+	if limit > 0 {
+		query = strings.Replace(query, "SELECT", "SELECT TOP (@Limit)", 1)
+		params = append(params, sql.Named("Limit", limit))
+	}
+
 	if endOID > 0 {
 		query += ` AND smy.OID <= @EndOID`
 		params = append(params, sql.Named("EndOID", endOID))
 	}
 
+	// Add optional device condition
+	if c.deviceFilter > 0 {
+		query += ` AND smy.MilkingDevice = @Device`
+		params = append(params, sql.Named("Device", c.deviceFilter))
+	}
+
+	// Add operator defined conditions, columns and operators come from allowlists and values are parameters
+	for i, f := range c.extraFilters {
+		name := fmt.Sprintf("Filter%d", i)
+		query += fmt.Sprintf(` AND %s %s @%s`, filterColumns[f.Field], f.Operator, name)
+		params = append(params, sql.Named(name, f.Value))
+	}
+
 	query += ` ORDER BY smy.OID`
+	return query, params
+}
+
+// deviceUtilizationQuery builds the device utilization query and its named parameters
+func (c *Client) deviceUtilizationQuery(dbStart, dbEnd time.Time) (string, []any) {
+	query := deviceUtilizationQuery
+
+	var params []any
+	params = append(params, sql.Named("StartTime", dbStart), sql.Named("EndTime", dbEnd))
+
+	if c.deviceFilter > 0 {
+		query += ` AND smy.MilkingDevice = @Device`
+		params = append(params, sql.Named("Device", c.deviceFilter))
+	}
+
+	query += ` GROUP BY smy.MilkingDevice`
+	return query, params
+}
+
+// GetMilkingRecords retrieves milking records from the database for the specified duration
+func (c *Client) GetMilkingRecords(ctx context.Context, start, end time.Time, lastOID int64) ([]*models.MilkingRecord, error) {
+	records, _, err := c.getMilkingRecords(ctx, queryMilkingRecords, start, end, lastOID, 0, 0)
+	return records, err
+}
+
+// GetMilkingRecordsWithOIDRange retrieves milking records from the database for the specified duration and OID range
+func (c *Client) GetMilkingRecordsWithOIDRange(ctx context.Context, start, end time.Time, startOID, endOID int64) ([]*models.MilkingRecord, error) {
+	records, _, err := c.getMilkingRecords(ctx, queryMilkingRecordsOIDRange, start, end, startOID, endOID, 0)
+	return records, err
+}
 
+// GetMilkingRecordsPage retrieves the records of the limit lowest OIDs of a duration and OID range, along with the
+// cursor to pass as startOID of the next page, 0 once the range is exhausted
+// The cursor follows the rows read from the database, so that a page whose animals are all excluded does not end paging
+func (c *Client) GetMilkingRecordsPage(ctx context.Context, start, end time.Time, startOID, endOID int64, limit int) ([]*models.MilkingRecord, int64, error) {
+	records, scanned, err := c.getMilkingRecords(ctx, queryMilkingRecordsOIDRange, start, end, startOID, endOID, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// A full page may be followed by more rows
+	var nextOID int64
+	if scanned.rows >= limit {
+		nextOID = scanned.highestOID
+	}
+	return records, nextOID, nil
+}
+
+// scanSummary describes the rows read by a query, including those left out of its records
+type scanSummary struct {
+	rows       int   // Number of rows read
+	highestOID int64 // Highest OID read
+}
+
+// queryDurationBuckets are the upper bounds of query duration buckets in the Prometheus histogram format
+var queryDurationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Query names of the query duration metric
+const (
+	queryMilkingRecords         = "milking_records"
+	queryMilkingRecordsOIDRange = "milking_records_oid_range"
+	queryDeviceUtilization      = "device_utilization"
+	queryLactatingAnimals       = "lactating_animals"
+	queryWeightRecords          = "weight_records"
+)
+
+// queryContext runs a query and records its duration under the given query name
+func (c *Client) queryContext(ctx context.Context, name, query string, params ...any) (*sql.Rows, error) {
+	start := time.Now()
 	rows, err := c.db.QueryContext(ctx, query, params...)
+	metricName := c.naming.LabeledMetricName(models.MetricDBQueryDuration, fmt.Sprintf("query=%q", name))
+	if c.prometheusHistogram {
+		c.metrics.GetOrCreatePrometheusHistogramExt(metricName, queryDurationBuckets).UpdateDuration(start)
+	} else {
+		c.metrics.GetOrCreateHistogram(metricName).UpdateDuration(start)
+	}
+	return rows, err
+}
+
+// getMilkingRecords retrieves milking records for the specified duration and OID range, recording the query duration under name
+// The summary counts every row read, records left out by the animal selection or failing to scan included
+func (c *Client) getMilkingRecords(ctx context.Context, name string, start, end time.Time, startOID, endOID int64, limit int) ([]*models.MilkingRecord, scanSummary, error) {
+	// Convert query times to database timezone
+	query, params := c.milkingRecordsQuery(c.convertToDBTime(start), c.convertToDBTime(end), startOID, endOID, limit)
+
+	rows, err := c.queryContext(ctx, name, query, params...)
 	if err != nil {
 		log.Printf("Error querying milking metrics: %v", err)
-		return nil, err
+		return nil, scanSummary{}, err
 	}
 	defer rows.Close()
 
 	var records []*models.MilkingRecord
+	var scanned scanSummary
 	for rows.Next() {
 		record := &models.MilkingRecord{}
+		var quarterYields, quarterPeakFlows [4]*float64
 
-		if err := rows.Scan(
+		err := rows.Scan(
 			&record.OID,
 			&record.AnimalNumber,
 			&record.AnimalName,
 			&record.AnimalRegNo,
 			&record.BreedName,
+			&record.BreedID,
 			&record.DeviceID,
 			&record.DestinationName,
 			&record.LactationNumber,
 			&record.DaysInLactation,
+			&record.LactationYield,
 			&record.Yield,
 			&record.Conductivity,
+			&record.Temperature,
 			&record.Duration,
 			&record.SomaticCellCount,
 			&record.Incomplete,
 			&record.Kickoff,
+			&record.ManualAttach,
+			&quarterYields[0], &quarterYields[1], &quarterYields[2], &quarterYields[3],
+			&quarterPeakFlows[0], &quarterPeakFlows[1], &quarterPeakFlows[2], &quarterPeakFlows[3],
 			&record.BeginTime,
 			&record.EndTime,
-		); err != nil {
+		)
+		// The OID is the first column, so it is read even when a later column fails to scan
+		scanned.rows++
+		scanned.highestOID = max(scanned.highestOID, record.OID)
+		if err != nil {
 			log.Printf("Error scanning row: %v", err)
 			continue
 		}
 
+		// SQL Server renders numbers wider than the cast width as *, which would merge distinct animals
+		if record.AnimalNumber == overflowNumber {
+			log.Printf("Skipping session %d, its animal number is wider than the animal number width %d", record.OID, c.numberWidth)
+			continue
+		}
+
+		if !c.animalSelected(record.AnimalNumber) {
+			continue
+		}
+
 		// Clean label values for Prometheus (remove quotes and special characters)
-		record.AnimalName = cleanLabelValue(record.AnimalName)
-		record.AnimalRegNo = cleanLabelValue(record.AnimalRegNo)
-		record.BreedName = cleanLabelValue(record.BreedName)
-		record.DestinationName = cleanLabelValue(record.DestinationName)
+		cleanRecordLabels(record)
 
-		// Translate breed name to French
-		record.BreedName = translateBreedToFrench(record.BreedName)
+		// Translate breed name to the configured locale
+		record.BreedName = c.translateBreed(record.BreedName)
 
 		// Convert database timestamps back to UTC
 		record.BeginTime = c.convertFromDBTime(record.BeginTime)
 		record.EndTime = c.convertFromDBTime(record.EndTime)
 
+		record.QuarterYields = quarterValues(quarterYields)
+		record.QuarterPeakFlows = quarterValues(quarterPeakFlows)
+
 		records = append(records, record)
 	}
 
-	return records, nil
+	// A failure during iteration (e.g. dropped connection) must not be mistaken for the end of results
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating milking metrics: %v", err)
+		return nil, scanSummary{}, err
+	}
+
+	return records, scanned, nil
+}
+
+// quarterValues maps per quarter values in models.AllTeats order to their teat, leaving out NULL values of older records
+func quarterValues(values [4]*float64) map[models.Teat]float64 {
+	quarters := make(map[models.Teat]float64)
+	for i, teat := range models.AllTeats {
+		if values[i] != nil {
+			quarters[teat] = *values[i]
+		}
+	}
+	return quarters
+}
+
+// GetMaxOID returns the highest milking session OID in the database, 0 when there is none
+func (c *Client) GetMaxOID(ctx context.Context) (int64, error) {
+	var maxOID int64
+	if err := c.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(OID), 0) FROM SessionMilkYield`).Scan(&maxOID); err != nil {
+		log.Printf("Error querying highest OID: %v", err)
+		return 0, err
+	}
+	return maxOID, nil
+}
+
+// GetTotalSessions returns the number of milking sessions in the database, restricted to the device filter when set
+func (c *Client) GetTotalSessions(ctx context.Context) (int64, error) {
+	query := `SELECT COUNT_BIG(*) FROM SessionMilkYield`
+	var params []any
+	if c.deviceFilter > 0 {
+		query += ` WHERE MilkingDevice = @Device`
+		params = append(params, sql.Named("Device", c.deviceFilter))
+	}
+
+	var total int64
+	if err := c.db.QueryRowContext(ctx, query, params...).Scan(&total); err != nil {
+		log.Printf("Error counting milking sessions: %v", err)
+		return 0, err
+	}
+	return total, nil
+}
+
+// utilizationWindow returns the 24h device utilization window ending at now,
+// or at the start of the current hour in the database timezone when the partial hour is excluded
+func (c *Client) utilizationWindow(now time.Time) (time.Time, time.Time) {
+	end := now
+	if c.excludeCurrentHour {
+		local := now.In(c.dbLocation)
+		end = time.Date(local.Year(), local.Month(), local.Day(), local.Hour(), 0, 0, 0, c.dbLocation)
+	}
+	return end.Add(-24 * time.Hour), end
 }
 
 // GetDeviceUtilization retrieves device utilization metrics
-func (c *Client) GetDeviceUtilization(ctx context.Context) (map[string]int, error) {
-	query := `
-		SELECT 
-			CAST(MilkingDevice AS VARCHAR(10)) as device_id,
-			COUNT(*) as session_count
-		FROM SessionMilkYield 
-		WHERE BeginTime >= DATEADD(day, -1, GETDATE())
-		AND TotalYield IS NOT NULL
-		GROUP BY MilkingDevice
-	`
-
-	rows, err := c.db.QueryContext(ctx, query)
+func (c *Client) GetDeviceUtilization(ctx context.Context) (map[string]models.DeviceUtilization, error) {
+	start, end := c.utilizationWindow(time.Now())
+	query, params := c.deviceUtilizationQuery(c.convertToDBTime(start), c.convertToDBTime(end))
+
+	rows, err := c.queryContext(ctx, queryDeviceUtilization, query, params...)
 	if err != nil {
 		log.Printf("Error querying device utilization: %v", err)
 		return nil, err
 	}
 	defer rows.Close()
 
-	utilization := make(map[string]int)
+	utilization := make(map[string]models.DeviceUtilization)
 	for rows.Next() {
 		var deviceID string
-		var sessionCount int
+		var u models.DeviceUtilization
 
-		if err := rows.Scan(&deviceID, &sessionCount); err != nil {
+		if err := rows.Scan(&deviceID, &u.Sessions, &u.IncompleteSessions); err != nil {
 			log.Printf("Error scanning device utilization row: %v", err)
 			continue
 		}
 
-		utilization[deviceID] = sessionCount
+		utilization[deviceID] = u
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating device utilization: %v", err)
+		return nil, err
 	}
 
 	return utilization, nil
 }
 
+// GetLactatingAnimals retrieves the animals with an open lactation and the end of their last session in it
+func (c *Client) GetLactatingAnimals(ctx context.Context) ([]models.LactatingAnimal, error) {
+	rows, err := c.queryContext(ctx, queryLactatingAnimals, fmt.Sprintf(lactatingAnimalsQuery, c.numberWidth))
+	if err != nil {
+		log.Printf("Error querying lactating animals: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var animals []models.LactatingAnimal
+	for rows.Next() {
+		var a models.LactatingAnimal
+
+		if err := rows.Scan(&a.AnimalNumber, &a.AnimalName, &a.AnimalRegNo, &a.LastSession); err != nil {
+			log.Printf("Error scanning lactating animal row: %v", err)
+			continue
+		}
+
+		if a.AnimalNumber == overflowNumber {
+			log.Printf("Skipping lactating animal whose animal number is wider than the animal number width %d", c.numberWidth)
+			continue
+		}
+
+		if !c.animalSelected(a.AnimalNumber) {
+			continue
+		}
+
+		a.AnimalName = cleanLabelValue(a.AnimalName)
+		a.AnimalRegNo = cleanLabelValue(a.AnimalRegNo)
+		if a.LastSession != nil {
+			lastSession := c.convertFromDBTime(*a.LastSession)
+			a.LastSession = &lastSession
+		}
+
+		animals = append(animals, a)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating lactating animals: %v", err)
+		return nil, err
+	}
+
+	return animals, nil
+}
+
+// ErrWeightUnavailable is returned by GetWeightRecords when the database has no weighing table
+var ErrWeightUnavailable = errors.New("no " + weightTable + " table, the setup has no walk-over scales")
+
+// GetWeightRecords retrieves the latest weighing of each animal weighed within the specified duration
+func (c *Client) GetWeightRecords(ctx context.Context, start, end time.Time) ([]models.WeightRecord, error) {
+	var exists bool
+	if err := c.db.QueryRowContext(ctx, `SELECT CAST(CASE WHEN OBJECT_ID(@Table, 'U') IS NULL THEN 0 ELSE 1 END AS BIT)`,
+		sql.Named("Table", weightTable)).Scan(&exists); err != nil {
+		log.Printf("Error checking weight table: %v", err)
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrWeightUnavailable
+	}
+
+	rows, err := c.queryContext(ctx, queryWeightRecords, fmt.Sprintf(weightRecordsQuery, c.numberWidth),
+		sql.Named("StartTime", c.convertToDBTime(start)), sql.Named("EndTime", c.convertToDBTime(end)))
+	if err != nil {
+		log.Printf("Error querying weight records: %v", err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var weights []models.WeightRecord
+	for rows.Next() {
+		var w models.WeightRecord
+
+		if err := rows.Scan(&w.AnimalNumber, &w.AnimalName, &w.AnimalRegNo, &w.Weight, &w.Time); err != nil {
+			log.Printf("Error scanning weight row: %v", err)
+			continue
+		}
+
+		if w.AnimalNumber == overflowNumber {
+			log.Printf("Skipping weighing whose animal number is wider than the animal number width %d", c.numberWidth)
+			continue
+		}
+
+		if !c.animalSelected(w.AnimalNumber) {
+			continue
+		}
+
+		w.AnimalName = cleanLabelValue(w.AnimalName)
+		w.AnimalRegNo = cleanLabelValue(w.AnimalRegNo)
+		w.Time = c.convertFromDBTime(w.Time)
+
+		weights = append(weights, w)
+	}
+
+	if err := rows.Err(); err != nil {
+		log.Printf("Error iterating weight records: %v", err)
+		return nil, err
+	}
+
+	return weights, nil
+}
+
+// cleanRecordLabels cleans the label values of a milking record, recording the labels altered by cleaning
+// They are counted by the live metrics, which unlike other queries see each record once
+func cleanRecordLabels(record *models.MilkingRecord) {
+	labels := []struct {
+		name  string
+		value *string
+	}{
+		{"animal_name", &record.AnimalName},
+		{"animal_reg_no", &record.AnimalRegNo},
+		{"breed", &record.BreedName},
+		{"destination", &record.DestinationName},
+	}
+	for _, label := range labels {
+		if cleaned := cleanLabelValue(*label.value); cleaned != *label.value {
+			*label.value = cleaned
+			record.CleanedLabels = append(record.CleanedLabels, label.name)
+		}
+	}
+}
+
 // cleanLabelValue removes problematic characters from Prometheus label values
 func cleanLabelValue(value string) string {
 	value = strings.ReplaceAll(value, "\"", "")
@@ -251,19 +918,3 @@ func cleanLabelValue(value string) string {
 	value = strings.ReplaceAll(value, "\r", "")
 	return value
 }
-
-// translateBreedToFrench converts English breed names to French equivalents
-func translateBreedToFrench(englishBreed string) string {
-	frenchBreeds := map[string]string{
-		"Holstein Friesian":     "Holstein",
-		"Montbeliard":           "Montbéliarde",
-		"Swedish Red-and-White": "Rouge Suédoise",
-		"Cross Breed":           "Croisée",
-		"Unknown Breed":         "Race Inconnue",
-	}
-
-	if frenchName, exists := frenchBreeds[englishBreed]; exists {
-		return frenchName
-	}
-	return englishBreed
-}
@@ -1,45 +1,196 @@
 package exporter
 
 import (
+	"cmp"
 	"compress/gzip"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net/http"
 	"os"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/VictoriaMetrics/metrics"
 	"github.com/clementnuss/delpro-exporter/internal/database"
 	delprometrics "github.com/clementnuss/delpro-exporter/internal/metrics"
 	"github.com/clementnuss/delpro-exporter/internal/models"
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // DelProExporter combines database and metrics operations
+// All methods are safe for concurrent use: UpdateMetrics, CatchUp and SetLastOID are serialized, as they share the
+// OID watermarks and the live metric state, while historical, stats and health handlers only read the database
+// client and the configuration, computing historical metrics in their own sets
 type DelProExporter struct {
-	db         *database.Client
-	metrics    *delprometrics.Exporter
-	oidFile    string
-	lastOID    int64
-	dbLocation *time.Location
+	db       atomic.Pointer[database.Client] // Nil until the database is reachable
+	dbConfig database.Config
+	metrics  *delprometrics.Exporter
+	oidFile  string
+	ready    atomic.Bool // Set once the first poll succeeded
+
+	newClient func(database.Config) (*database.Client, error) // Connects to the database, database.NewClient outside tests
+
+	outputTZ *time.Location // Timezone of date-only time parameters
+	maxRange time.Duration
+
+	updateMu sync.Mutex // Serializes live updates, guarding lastOID, deviceOIDs, animalsSeen and collectWeight
+	lastOID  int64
+
+	// Catch-up state, set once connected and guarded by updateMu
+	startupOID   int64     // Last processed OID when connecting, records up to it were not counted by this process
+	liveStart    time.Time // Start of the first live query window, earlier records were not counted either
+	caughtUpFrom int64     // Records with OID in (caughtUpFrom, caughtUpTo] were already examined by a catch-up
+	caughtUpTo   int64
+
+	lookbackWindow     time.Duration // Time window of live queries
+	historicalLookback time.Duration // Default time range of historical requests without start
+	driedOffAfter      time.Duration // Time without session after which lactating animals are dried off, 0 disables
+	collectWeight      bool          // Collect walk-over scale weights, disabled when the database has none
+
+	staleAnimalAfter time.Duration         // Time without session after which animal series are removed, 0 disables
+	animalsSeen      map[string]seenAnimal // Last session of each animal with series, keyed by animal number
+
+	perDevice  bool
+	deviceOIDs map[string]int64 // Last processed OID per device, when perDevice is set
+	recoverOID bool             // Advance the last processed OID to the database maximum once connected
+
+	valuePrecision int  // Decimals of emitted values, negative to keep full precision
+	sourceLabel    bool // Add a source label telling live and historical series apart
+
+	disableHistoricalGzip bool // Send uncompressed historical responses whatever the Accept-Encoding
+
+	historicalRetries      int           // Retries of failed historical queries
+	historicalRetryBackoff time.Duration // Wait before the first retry, growing linearly
+
+	collectOnScrape    bool
+	minCollectInterval time.Duration // Time during which scrape-time collections reuse the previous result
+	collectMu          sync.Mutex    // Guards inflight and lastCollect
+	inflight           chan struct{} // Closed when the running scrape-time collection completes
+	lastCollect        time.Time     // End of the last scrape-time collection
+
+	otlp *delprometrics.OTLPPusher // Pushes metrics after each update when an OTLP endpoint is configured
+}
+
+// DefaultMinCollectInterval is the default minimum interval between scrape-time collections
+const DefaultMinCollectInterval = 10 * time.Second
+
+// Config holds the DelPro exporter settings
+type Config struct {
+	Database    database.Config
+	IsolatedSet bool // Keep live metrics in a set owned by the exporter instead of the global default set
+	Metrics     delprometrics.Config
+
+	HistoricalMaxRange time.Duration // Maximum time range of historical requests (0 means unlimited)
+	LookbackWindow     time.Duration // Time window of live queries, models.DefaultLookbackWindow when 0
+	HistoricalLookback time.Duration // Default time range of historical requests, models.HistoricalLookbackHours when 0
+	DriedOffAfter      time.Duration // Time without session after which lactating animals are dried off, 0 disables
+	StaleAnimalAfter   time.Duration // Time without session after which the series of an animal are removed, 0 disables
+	CollectWeight      bool          // Collect walk-over scale weights when the database has them
+	PerDeviceWatermark bool          // Track the last processed OID of each device in the OID file
+	RecoverOIDFromDB   bool          // Advance the last processed OID to the highest OID in the database at startup
+	CollectOnScrape    bool          // Collect metrics when /metrics is scraped instead of in the background
+	MinCollectInterval time.Duration // Minimum interval between scrape-time collections
+
+	// OutputLocation is the timezone of date-only time parameters, the database timezone when nil
+	// It only affects presentation, queries always convert times with the database timezone
+	OutputLocation *time.Location
+
+	ValuePrecision int  // Decimals of emitted values, negative to keep full precision
+	SourceLabel    bool // Add a source="live" or source="historical" label to every emitted series
+
+	Settings []models.ConfigSetting // Effective configuration, exposed as info metrics
+
+	DisableHistoricalGzip bool // Send uncompressed historical responses whatever the Accept-Encoding
+
+	HistoricalRetries      int           // Retries of failed historical queries before answering with an error
+	HistoricalRetryBackoff time.Duration // Wait before the first retry, growing linearly
+
+	// OTLPEndpoint is the OTLP/HTTP metrics endpoint to push metrics to after each update, disabled when empty
+	// Duration histograms must use the Prometheus format
+	OTLPEndpoint string
+}
+
+// seenAnimal identifies an animal with series and records the end of its last session
+type seenAnimal struct {
+	regNo    string
+	lastSeen time.Time
 }
 
+// Values of the source label
+const (
+	sourceLive       = "live"
+	sourceHistorical = "historical"
+)
+
 // NewDelProExporter creates a new DelPro exporter instance
-func NewDelProExporter(host, port, dbname, user, password string, dbLocation *time.Location) *DelProExporter {
+func NewDelProExporter(cfg Config) *DelProExporter {
 	// Determine OID file path - use working directory if available
 	oidFilePath := "delpro_last_oid.txt"
 	if wd, err := os.Getwd(); err == nil {
 		oidFilePath = wd + "/delpro_last_oid.txt"
 	}
 
+	var set *metrics.Set
+	if cfg.IsolatedSet {
+		set = metrics.NewSet()
+	}
+
+	metricsExporter := delprometrics.NewExporter(set, cfg.Metrics)
+	metricsExporter.CreateConfigMetrics(cfg.Settings)
+	metricsExporter.SetDBConnected(false)
+	cfg.Database.Metrics = metricsExporter.Set()
+	cfg.Database.PrometheusHistogram = cfg.Metrics.DurationHistogram == delprometrics.HistogramPrometheus
+	cfg.Database.VersionLabel = cfg.Metrics.VersionLabel
+
 	exporter := &DelProExporter{
-		db:         database.NewClient(host, port, dbname, user, password, dbLocation),
-		metrics:    delprometrics.NewExporter(),
+		dbConfig:   cfg.Database,
+		newClient:  database.NewClient,
+		metrics:    metricsExporter,
 		oidFile:    oidFilePath,
-		dbLocation: dbLocation,
+		outputTZ:   cmp.Or(cfg.OutputLocation, cfg.Database.Location),
+		maxRange:   cfg.HistoricalMaxRange,
+		perDevice:  cfg.PerDeviceWatermark,
+		deviceOIDs: make(map[string]int64),
+		recoverOID: cfg.RecoverOIDFromDB,
+
+		lookbackWindow:     cmp.Or(cfg.LookbackWindow, models.DefaultLookbackWindow),
+		historicalLookback: cmp.Or(cfg.HistoricalLookback, models.HistoricalLookbackHours),
+		driedOffAfter:      cfg.DriedOffAfter,
+		collectWeight:      cfg.CollectWeight,
+
+		staleAnimalAfter: cfg.StaleAnimalAfter,
+		animalsSeen:      make(map[string]seenAnimal),
+
+		collectOnScrape:    cfg.CollectOnScrape,
+		minCollectInterval: cfg.MinCollectInterval,
+
+		valuePrecision: cfg.ValuePrecision,
+		sourceLabel:    cfg.SourceLabel,
+
+		disableHistoricalGzip: cfg.DisableHistoricalGzip,
+
+		historicalRetries:      max(cfg.HistoricalRetries, 0),
+		historicalRetryBackoff: cfg.HistoricalRetryBackoff,
+	}
+
+	if cfg.OTLPEndpoint != "" {
+		// The collector does not collect on scrape, pushes already follow an update
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(delprometrics.NewCollector(func(w io.Writer) error {
+			return exporter.writeLiveMetrics(w, nil)
+		}))
+		exporter.otlp = delprometrics.NewOTLPPusher(cfg.OTLPEndpoint, registry)
 	}
 
 	log.Printf("Using OID file path: %s", oidFilePath)
@@ -47,35 +198,190 @@ func NewDelProExporter(host, port, dbname, user, password string, dbLocation *ti
 	// Load last processed OID from file
 	exporter.loadLastOID()
 
+	// The database is connected by the first metrics update, so that metrics are served even when it is not reachable yet
+	return exporter
+}
+
+// errDBUnavailable is returned by operations requiring a database connection before it could be established
+var errDBUnavailable = errors.New("database not connected yet")
+
+// connect returns the database client, connecting first when the database was not reachable so far
+// It must not be called concurrently, which updateMu guarantees
+func (e *DelProExporter) connect() (*database.Client, error) {
+	if db := e.db.Load(); db != nil {
+		return db, nil
+	}
+
+	db, err := e.newClient(e.dbConfig)
+	if err != nil {
+		e.metrics.SetDBConnected(false)
+		return nil, err
+	}
+	e.db.Store(db)
+	e.metrics.SetDBConnected(true)
+
+	if e.recoverOID {
+		e.recoverLastOID(db)
+	}
+	e.startupOID = e.lastOID
+	e.liveStart = time.Now().Add(-models.LiveDelay - e.lookbackWindow)
+	e.caughtUpFrom, e.caughtUpTo = e.startupOID, e.startupOID
+
 	// Initialize counters for animals from past 24h to ensure proper increase() calculations
-	exporter.initializeCounters()
+	e.initializeCounters(db)
 
-	return exporter
+	return db, nil
 }
 
 // Close closes the database connection
 func (e *DelProExporter) Close() error {
-	return e.db.Close()
+	if db := e.db.Load(); db != nil {
+		return db.Close()
+	}
+	return nil
 }
 
 // UpdateMetrics collects and updates current metrics from the database
+// Each collection phase is independent, so that one failing does not prevent the others from running
+// Concurrent calls do not overlap, a call waits for the running update to complete
+// Metrics are pushed to the OTLP endpoint once the update is done, so that a slow endpoint does not delay other updates
 func (e *DelProExporter) UpdateMetrics() {
+	e.update()
+	if e.otlp != nil {
+		e.pushOTLP()
+	}
+}
+
+// update collects and updates current metrics from the database, holding the update lock
+func (e *DelProExporter) update() {
+	e.updateMu.Lock()
+	defer e.updateMu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		e.metrics.ObserveUpdateDuration(time.Since(start))
+		e.metrics.SetHeartbeat(time.Now())
+		e.metrics.SetRuntimeMetrics()
+	}()
+
+	db, err := e.connect()
+	if err != nil {
+		log.Printf("Error connecting to database, retrying on the next metrics update: %v", err)
+		for _, collector := range e.collectors() {
+			e.metrics.SetScrapeResult(collector, 0, false)
+		}
+		return
+	}
+
 	// Create context with timeout for database operations
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	// Get records since last processed OID to prevent duplicate counter increments
-	// Add 5 minute delay in live mode to ensure voluntary session milk yield data is populated
-	now := time.Now().Add(-5 * time.Minute)
+	milkingOK := e.runCollector(collectorMilking, func() error { return e.updateMilkingMetrics(ctx, db) })
+	utilizationOK := e.runCollector(collectorUtilization, func() error { return e.updateDeviceUtilization(ctx, db) })
+	sessionsOK := e.runCollector(collectorSessions, func() error { return e.updateTotalSessions(ctx, db) })
+	success := milkingOK && utilizationOK && sessionsOK
+	if e.driedOffAfter > 0 {
+		success = e.runCollector(collectorDriedOff, func() error { return e.updateDriedOff(ctx, db) }) && success
+	}
+	if e.collectWeight {
+		success = e.runCollector(collectorWeight, func() error { return e.updateWeights(ctx, db) }) && success
+	}
+
+	e.metrics.CreateConnectionPoolMetrics(db.Stats())
+
+	if success && !e.ready.Swap(true) {
+		log.Printf("First metrics update successful, exporter is ready")
+	}
+}
+
+// Collection phases of UpdateMetrics, reported in the collector label of scrape metrics
+const (
+	collectorMilking     = "milking"
+	collectorUtilization = "utilization"
+	collectorSessions    = "sessions"
+	collectorDriedOff    = "dried_off"
+	collectorWeight      = "weight"
+)
+
+// collectors returns the enabled collection phases
+func (e *DelProExporter) collectors() []string {
+	collectors := []string{collectorMilking, collectorUtilization, collectorSessions}
+	if e.driedOffAfter > 0 {
+		collectors = append(collectors, collectorDriedOff)
+	}
+	if e.collectWeight {
+		collectors = append(collectors, collectorWeight)
+	}
+	return collectors
+}
+
+// runCollector runs a collection phase and records its duration and outcome
+func (e *DelProExporter) runCollector(collector string, collect func() error) bool {
+	start := time.Now()
+	err := collect()
+	e.metrics.SetScrapeResult(collector, time.Since(start), err == nil)
 
-	records, err := e.db.GetMilkingRecords(ctx, now.Add(-models.DefaultLookbackWindow), now, e.lastOID)
 	if err != nil {
-		log.Printf("Error collecting milking metrics: %v", err)
+		log.Printf("Error collecting %s metrics: %v", collector, err)
+		return false
+	}
+	return true
+}
+
+// collectIfStale updates metrics unless a collection completed within the minimum collect interval
+// Concurrent scrapes share the running collection instead of querying the database again
+func (e *DelProExporter) collectIfStale() {
+	e.collectMu.Lock()
+	if done := e.inflight; done != nil {
+		e.collectMu.Unlock()
+		<-done
+		return
+	}
+	if time.Since(e.lastCollect) < e.minCollectInterval {
+		e.collectMu.Unlock()
 		return
 	}
+	done := make(chan struct{})
+	e.inflight = done
+	e.collectMu.Unlock()
+
+	e.UpdateMetrics()
+
+	e.collectMu.Lock()
+	e.inflight = nil
+	e.lastCollect = time.Now()
+	e.collectMu.Unlock()
+	close(done)
+}
+
+// updateMilkingMetrics updates metrics from new milking records and advances the last processed OID
+func (e *DelProExporter) updateMilkingMetrics(ctx context.Context, db *database.Client) error {
+	// Get records since last processed OID to prevent duplicate counter increments
+	// Add delay in live mode to ensure voluntary session milk yield data is populated
+	now := time.Now().Add(-models.LiveDelay)
+
+	startOID := e.lastOID
+	if e.perDevice {
+		// Start from the lowest device watermark, records already processed for a device are skipped below
+		for _, oid := range e.deviceOIDs {
+			startOID = min(startOID, oid)
+		}
+	}
+
+	records, err := db.GetMilkingRecords(ctx, now.Add(-e.lookbackWindow), now, startOID)
+	if err != nil {
+		return err
+	}
+
+	if e.perDevice {
+		records = e.filterDeviceWatermarks(records)
+	}
 
 	// Update metrics only for new records
-	e.metrics.CreateMetricsFromRecords(nil, nil, records)
+	e.metrics.CreateMetricsFromRecords(records)
+	e.markAnimalsSeen(records)
+	e.removeStaleAnimals(time.Now())
 
 	// Update last processed OID if we have new records
 	if len(records) > 0 {
@@ -84,31 +390,232 @@ func (e *DelProExporter) UpdateMetrics() {
 			if record.OID > highestOID {
 				highestOID = record.OID
 			}
+			if e.perDevice && record.OID > e.deviceOIDs[record.DeviceID] {
+				e.deviceOIDs[record.DeviceID] = record.OID
+			}
 		}
-		if highestOID > e.lastOID {
-			e.lastOID = highestOID
-			e.saveLastOID()
-			log.Printf("Updated last processed OID to: %d", e.lastOID)
+		e.lastOID = max(e.lastOID, highestOID)
+		e.saveLastOID()
+		log.Printf("Updated last processed OID to: %d", e.lastOID)
+	}
+
+	return nil
+}
+
+// markAnimalsSeen records the last session of the animals of records
+func (e *DelProExporter) markAnimalsSeen(records []*models.MilkingRecord) {
+	for _, record := range records {
+		if seen, exists := e.animalsSeen[record.AnimalNumber]; !exists || record.EndTime.After(seen.lastSeen) {
+			e.animalsSeen[record.AnimalNumber] = seenAnimal{regNo: record.AnimalRegNo, lastSeen: record.EndTime}
 		}
 	}
+}
 
-	utilization, err := e.db.GetDeviceUtilization(ctx)
-	if err != nil {
-		log.Printf("Error collecting device utilization: %v", err)
+// removeStaleAnimals removes the series of animals without session within the stale animal duration,
+// such as sold or dried-off animals, so that dashboards do not show their last values forever
+func (e *DelProExporter) removeStaleAnimals(now time.Time) {
+	if e.staleAnimalAfter <= 0 {
 		return
 	}
 
+	cutoff := now.Add(-e.staleAnimalAfter)
+	for number, seen := range e.animalsSeen {
+		if seen.lastSeen.Before(cutoff) {
+			removed := e.metrics.RemoveAnimal(number, seen.regNo)
+			delete(e.animalsSeen, number)
+			log.Printf("Removed %d series of animal %s, last seen at %s", removed, number, seen.lastSeen.Format(time.RFC3339))
+		}
+	}
+}
+
+// filterDeviceWatermarks drops records already processed according to their device watermark
+// Devices without a watermark of their own use the global last processed OID
+func (e *DelProExporter) filterDeviceWatermarks(records []*models.MilkingRecord) []*models.MilkingRecord {
+	var filtered []*models.MilkingRecord
+	for _, record := range records {
+		watermark, exists := e.deviceOIDs[record.DeviceID]
+		if !exists {
+			watermark = e.lastOID
+		}
+		if record.OID > watermark {
+			filtered = append(filtered, record)
+		}
+	}
+	return filtered
+}
+
+// updateDeviceUtilization updates device utilization metrics
+func (e *DelProExporter) updateDeviceUtilization(ctx context.Context, db *database.Client) error {
+	utilization, err := db.GetDeviceUtilization(ctx)
+	if err != nil {
+		return err
+	}
+
 	e.metrics.CreateDeviceUtilizationMetrics(utilization)
+	return nil
+}
+
+// updateTotalSessions updates the number of milking sessions in the database
+func (e *DelProExporter) updateTotalSessions(ctx context.Context, db *database.Client) error {
+	total, err := db.GetTotalSessions(ctx)
+	if err != nil {
+		return err
+	}
+
+	e.metrics.SetTotalSessions(total)
+	return nil
+}
+
+// updateDriedOff updates the dried-off flag of animals with an open lactation
+func (e *DelProExporter) updateDriedOff(ctx context.Context, db *database.Client) error {
+	animals, err := db.GetLactatingAnimals(ctx)
+	if err != nil {
+		return err
+	}
+
+	e.metrics.CreateDriedOffMetrics(animals, time.Now().Add(-e.driedOffAfter))
+	return nil
+}
+
+// Ping verifies that the database is reachable, failing while the exporter is not connected
+func (e *DelProExporter) Ping(ctx context.Context) error {
+	db := e.db.Load()
+	if db == nil {
+		return errDBUnavailable
+	}
+	return db.Ping(ctx)
+}
+
+// updateWeights updates the latest weights of animals weighed within the lookback window
+// Weight collection is turned off when the database has no weighings, as on setups without walk-over scales
+func (e *DelProExporter) updateWeights(ctx context.Context, db *database.Client) error {
+	now := time.Now()
+	weights, err := db.GetWeightRecords(ctx, now.Add(-e.lookbackWindow), now)
+	if errors.Is(err, database.ErrWeightUnavailable) {
+		log.Printf("Disabling weight collection: %v", err)
+		e.collectWeight = false
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	e.metrics.CreateWeightMetrics(weights)
+	return nil
+}
+
+// Ready reports whether the exporter completed its first successful metrics update
+func (e *DelProExporter) Ready() bool {
+	return e.ready.Load()
+}
+
+// CatchUp adds the records with OID above fromOID that the live metrics never counted to the live counters:
+// those recorded before connecting, at or below the OID watermark at the time, and those ending before the
+// first live query window, which later windows do not cover either
+// Gauges describing the latest sessions are left untouched, as well as the watermark, and records already caught
+// up are skipped, so that repeating a catch-up does not count anything twice
+func (e *DelProExporter) CatchUp(ctx context.Context, fromOID int64) (int, error) {
+	db := e.db.Load()
+	if db == nil {
+		return 0, errDBUnavailable
+	}
+
+	e.updateMu.Lock()
+	defer e.updateMu.Unlock()
+
+	var records []*models.MilkingRecord
+	if fromOID < e.caughtUpFrom {
+		older, err := db.GetMilkingRecordsWithOIDRange(ctx, oidOnlyStart, time.Now(), fromOID, e.caughtUpFrom)
+		if err != nil {
+			return 0, err
+		}
+		records = append(records, older...)
+	}
+	// Records above the caught-up range are always included, whatever fromOID, keeping the range contiguous
+	if e.caughtUpTo < e.lastOID {
+		newer, err := db.GetMilkingRecordsWithOIDRange(ctx, oidOnlyStart, time.Now(), e.caughtUpTo, e.lastOID)
+		if err != nil {
+			return 0, err
+		}
+		records = append(records, newer...)
+	}
+
+	uncounted := slices.DeleteFunc(records, func(r *models.MilkingRecord) bool {
+		return r.OID > e.startupOID && !r.EndTime.Before(e.liveStart)
+	})
+	e.metrics.CatchUpRecords(uncounted)
+
+	log.Printf("Caught up %d records with OID in (%d, %d]", len(uncounted), min(fromOID, e.caughtUpFrom), e.lastOID)
+	e.caughtUpFrom = min(fromOID, e.caughtUpFrom)
+	e.caughtUpTo = max(e.caughtUpTo, e.lastOID)
+	return len(uncounted), nil
+}
+
+// HandleCatchUp handles one-off catch-up requests of the form `POST /catchup?from_oid=N`
+func (e *DelProExporter) HandleCatchUp(r *http.Request, w http.ResponseWriter) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	fromOIDStr := r.URL.Query().Get("from_oid")
+	fromOID, err := strconv.ParseInt(fromOIDStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid from_oid format, must be a valid integer", http.StatusBadRequest)
+		return
+	}
+
+	count, err := e.CatchUp(ctx, fromOID)
+	if errors.Is(err, errDBUnavailable) {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("Unable to catch up milking metrics: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "processed %d records\n", count)
 }
 
 // WriteHistoricalMetrics writes metrics with timestamps in Prometheus exposition format
 func (e *DelProExporter) WriteHistoricalMetrics(r *http.Request, w http.ResponseWriter) {
+	db := e.db.Load()
+	if db == nil {
+		http.Error(w, errDBUnavailable.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
 	// Use request context with additional timeout for database operations
 	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
 	defer cancel()
 
 	query := r.URL.Query()
 	var records []*models.MilkingRecord
+	var nextOID int64 // Cursor of the next page, 0 without paging or on the last page
+
+	// Page size of OID range requests, 0 returns the whole range
+	limit, err := parseLimit(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit > 0 && !query.Has("start_oid") {
+		http.Error(w, "limit requires start_oid", http.StatusBadRequest)
+		return
+	}
+
+	// Output format, Prometheus exposition format by default
+	format := query.Get("format")
+	if format != "" && format != formatPrometheus && format != formatInflux {
+		http.Error(w, "invalid format, use prometheus or influx", http.StatusBadRequest)
+		return
+	}
 
 	// Check if OID range is specified
 	if query.Has("start_oid") {
@@ -119,14 +626,36 @@ func (e *DelProExporter) WriteHistoricalMetrics(r *http.Request, w http.Response
 			return
 		}
 
-		// Use time range for context, but OID range for filtering
-		startTime, endTime, err := e.parseTimeRangeWithLocation(r)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		// Records must match both the time and the OID range, unless the time range is disabled with range_mode=oid
+		var startTime, endTime time.Time
+		switch query.Get("range_mode") {
+		case "", rangeModeIntersect:
+			startTime, endTime, err = e.parseTimeRangeWithLocation(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		case rangeModeOID:
+			// Without time range, the page size is what bounds the response when the time range is limited
+			if e.maxRange > 0 && (limit == 0 || limit > maxOIDModeLimit) {
+				http.Error(w, fmt.Sprintf("range_mode=oid requires a limit of at most %d when the time range is limited", maxOIDModeLimit), http.StatusBadRequest)
+				return
+			}
+			startTime, endTime = oidOnlyStart, time.Now()
+		default:
+			http.Error(w, "invalid range_mode, use intersect or oid", http.StatusBadRequest)
 			return
 		}
 
-		records, err = e.db.GetMilkingRecordsWithOIDRange(ctx, startTime, endTime, startOID, endOID)
+		records, err = e.retryHistoricalQuery(ctx, func() ([]*models.MilkingRecord, error) {
+			if limit > 0 {
+				var records []*models.MilkingRecord
+				var err error
+				records, nextOID, err = db.GetMilkingRecordsPage(ctx, startTime, endTime, startOID, endOID, limit)
+				return records, err
+			}
+			return db.GetMilkingRecordsWithOIDRange(ctx, startTime, endTime, startOID, endOID)
+		})
 		if err != nil {
 			log.Printf("Unable to collect historical milking metrics by OID range: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -140,7 +669,9 @@ func (e *DelProExporter) WriteHistoricalMetrics(r *http.Request, w http.Response
 			return
 		}
 
-		records, err = e.db.GetMilkingRecords(ctx, startTime, endTime, 0)
+		records, err = e.retryHistoricalQuery(ctx, func() ([]*models.MilkingRecord, error) {
+			return db.GetMilkingRecords(ctx, startTime, endTime, 0)
+		})
 		if err != nil {
 			log.Printf("Unable to collect historical milking metrics: %v", err)
 			http.Error(w, "Internal server error", http.StatusInternalServerError)
@@ -161,27 +692,242 @@ func (e *DelProExporter) WriteHistoricalMetrics(r *http.Request, w http.Response
 		w.Header().Set("X-Highest-OID", strconv.FormatInt(highestOID, 10))
 	}
 
-	// Check if client accepts gzip compression
+	// A full page may be followed by more records, which the next request gets with start_oid set to the cursor
+	if nextOID > 0 {
+		w.Header().Set("X-Next-OID", strconv.FormatInt(nextOID, 10))
+	}
+
+	if format == formatInflux {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	// Announce the error trailer, set when the export fails after the response has started
+	w.Header().Set("Trailer", streamErrorTrailer)
+
+	// Some clients advertise compression they cannot decode on streamed responses
 	var writer io.Writer = w
-	acceptsGzip := strings.Contains(r.Header.Get("Accept-Encoding"), "gzip")
+	if !e.disableHistoricalGzip {
+		var closeWriter func() error
+		writer, closeWriter = compressedWriter(r, w)
+		defer closeWriter()
+	}
+
+	ew := &errorWriter{writer: writer}
+
+	// Writers converting the Prometheus output, flushed in order once done
+	var out io.Writer = ew
+	var flushers []interface{ Flush() error }
+	if format == formatInflux {
+		iw := delprometrics.NewInfluxWriter(out)
+		out = iw
+		flushers = append(flushers, iw)
+	}
+	if e.valuePrecision >= 0 {
+		pw := delprometrics.NewPrecisionWriter(out, e.valuePrecision)
+		out = pw
+		flushers = append(flushers, pw)
+	}
+	if e.sourceLabel {
+		lw := delprometrics.NewLabelWriter(out, fmt.Sprintf("source=%q", sourceHistorical))
+		out = lw
+		flushers = append(flushers, lw)
+	}
+	if format != formatInflux {
+		mw := delprometrics.NewMetadataWriter(out, e.metrics.Naming())
+		out = mw
+		flushers = append(flushers, mw)
+	}
+
+	err = e.metrics.WriteHistoricalMetricsWithInit(out, records)
+	for _, f := range slices.Backward(flushers) {
+		if flushErr := f.Flush(); err == nil {
+			err = flushErr
+		}
+	}
+	if err != nil && ew.err == nil {
+		ew.err = err
+	}
+	if ew.err != nil {
+		// The status code is already sent, flag the truncated body to the client as well as possible
+		log.Printf("Historical metrics export interrupted after %d bytes: %v", ew.written, ew.err)
+		fmt.Fprintf(writer, "# ERROR: historical export incomplete: %v\n", ew.err)
+		w.Header().Set(streamErrorTrailer, ew.err.Error())
+		return
+	}
+	log.Printf("Collected historical milking metrics for %d records", len(records))
+}
+
+// retryHistoricalQuery runs a historical query, retrying failures with a linear backoff
+// Records are fully fetched before the response is streamed, so a retry never duplicates output
+func (e *DelProExporter) retryHistoricalQuery(ctx context.Context, query func() ([]*models.MilkingRecord, error)) ([]*models.MilkingRecord, error) {
+	records, err := query()
+	for i := range e.historicalRetries {
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+		log.Printf("Historical query failed (retry %d/%d): %v", i+1, e.historicalRetries, err)
 
-	if acceptsGzip {
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(time.Duration(i+1) * e.historicalRetryBackoff):
+		}
+		records, err = query()
+	}
+	return records, err
+}
+
+// zstdEncoders reuses zstd encoders across responses, as each one allocates large buffers
+// Encoders run on a single goroutine, concurrent scrapes being encoded by distinct encoders
+var zstdEncoders = sync.Pool{
+	New: func() any {
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil
+		}
+		return encoder
+	},
+}
+
+// compressedWriter returns a writer compressing the response with the best encoding accepted by the client,
+// preferring zstd over gzip and falling back to plain output
+// The returned function must be called to flush the compressed stream
+func compressedWriter(r *http.Request, w http.ResponseWriter) (io.Writer, func() error) {
+	encodings := acceptedEncodings(r)
+
+	switch {
+	case encodings["zstd"]:
+		zstdWriter, ok := zstdEncoders.Get().(*zstd.Encoder)
+		if !ok {
+			log.Printf("Error creating zstd writer, falling back to plain output")
+			break
+		}
+		zstdWriter.Reset(w)
+		w.Header().Set("Content-Encoding", "zstd")
+		return zstdWriter, func() error {
+			err := zstdWriter.Close()
+			zstdEncoders.Put(zstdWriter)
+			return err
+		}
+	case encodings["gzip"]:
 		w.Header().Set("Content-Encoding", "gzip")
 		gzWriter := gzip.NewWriter(w)
-		defer gzWriter.Close()
-		writer = gzWriter
+		return gzWriter, gzWriter.Close
 	}
 
-	e.metrics.WriteHistoricalMetricsWithInit(writer, records)
-	log.Printf("Collected historical milking metrics for %d records", len(records))
+	return w, func() error { return nil }
+}
+
+// acceptedEncodings parses the Accept-Encoding header, ignoring encodings explicitly refused with q=0
+func acceptedEncodings(r *http.Request) map[string]bool {
+	encodings := make(map[string]bool)
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		encoding, params, _ := strings.Cut(part, ";")
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if weight, err := strconv.ParseFloat(q, 64); err == nil && weight == 0 {
+				continue
+			}
+		}
+		encodings[strings.ToLower(strings.TrimSpace(encoding))] = true
+	}
+	return encodings
+}
+
+// WriteStats writes aggregate herd statistics as JSON over the window given by the `window` duration parameter,
+// the lookback window of live queries by default
+func (e *DelProExporter) WriteStats(r *http.Request, w http.ResponseWriter) {
+	db := e.db.Load()
+	if db == nil {
+		http.Error(w, errDBUnavailable.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 60*time.Second)
+	defer cancel()
+
+	window := e.lookbackWindow
+	if windowStr := r.URL.Query().Get("window"); windowStr != "" {
+		parsedWindow, err := time.ParseDuration(windowStr)
+		if err != nil || parsedWindow <= 0 {
+			http.Error(w, "invalid window format, use a positive duration such as 24h", http.StatusBadRequest)
+			return
+		}
+		window = parsedWindow
+	}
+	if err := e.checkRange(window); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	end := time.Now()
+	start := end.Add(-window)
+	records, err := db.GetMilkingRecords(ctx, start, end, 0)
+	if err != nil {
+		log.Printf("Unable to collect herd statistics: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	writer, closeWriter := compressedWriter(r, w)
+	defer closeWriter()
+
+	if err := json.NewEncoder(writer).Encode(models.NewHerdStats(records, start, end)); err != nil {
+		log.Printf("Error writing herd statistics: %v", err)
+	}
+}
+
+// Historical metrics output formats
+const (
+	formatPrometheus = "prometheus"
+	formatInflux     = "influx"
+)
+
+// Historical OID range modes
+const (
+	rangeModeIntersect = "intersect" // Records within both the time and the OID range
+	rangeModeOID       = "oid"       // Records within the OID range, whatever their time
+)
+
+// maxOIDModeLimit is the largest page size of range_mode=oid requests when the historical time range is limited
+const maxOIDModeLimit = 10000
+
+// oidOnlyStart is the start time of OID only historical queries, before any DelPro session
+var oidOnlyStart = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// streamErrorTrailer is the HTTP trailer reporting errors occurring after the response has started
+const streamErrorTrailer = "X-Stream-Error"
+
+// errorWriter wraps an io.Writer and records the first write error
+type errorWriter struct {
+	writer  io.Writer
+	written int64
+	err     error
 }
 
-// parseTimeRangeWithLocation parses start and end time from HTTP request query parameters using database location
+// Write forwards data to the underlying writer until a write fails
+func (ew *errorWriter) Write(p []byte) (int, error) {
+	if ew.err != nil {
+		return 0, ew.err
+	}
+	n, err := ew.writer.Write(p)
+	ew.written += int64(n)
+	if err != nil {
+		ew.err = err
+	}
+	return n, err
+}
+
+// parseTimeRangeWithLocation parses start and end time from HTTP request query parameters using the output location
 func (e *DelProExporter) parseTimeRangeWithLocation(r *http.Request) (time.Time, time.Time, error) {
 	now := time.Now()
 
-	// Default to historical lookback period if no parameters provided
-	defaultStart := now.Add(-models.HistoricalLookbackHours)
+	// Default to historical lookback period if no parameters provided, within the maximum range
+	lookback := e.historicalLookback
+	if e.maxRange > 0 {
+		lookback = min(lookback, e.maxRange)
+	}
+	defaultStart := now.Add(-lookback)
 	defaultEnd := now
 
 	query := r.URL.Query()
@@ -189,27 +935,26 @@ func (e *DelProExporter) parseTimeRangeWithLocation(r *http.Request) (time.Time,
 	// Parse start parameter
 	startTime := defaultStart
 	if startStr := query.Get("start"); startStr != "" {
-		if parsedStart, err := time.Parse(time.RFC3339, startStr); err == nil {
-			startTime = parsedStart
-		} else if parsedStart, err := time.Parse("2006-01-02", startStr); err == nil {
-			// For date-only format, interpret in database timezone
-			startTime = time.Date(parsedStart.Year(), parsedStart.Month(), parsedStart.Day(), 0, 0, 0, 0, e.dbLocation)
-		} else {
-			return time.Time{}, time.Time{}, errors.New("invalid start time format, use RFC3339 (2006-01-02T15:04:05Z) or date format (2006-01-02)")
+		parsedStart, ok := e.parseTimeParam(startStr, now, false)
+		if !ok {
+			return time.Time{}, time.Time{}, errors.New("invalid start time format, " + timeFormatsHelp)
 		}
+		startTime = parsedStart
+	}
+
+	// No session can start in the future, which usually means a typo in the date
+	if startTime.After(now.Add(maxClockSkew)) {
+		return time.Time{}, time.Time{}, fmt.Errorf("start time %s is in the future, use a start time before now", startTime.Format(time.RFC3339))
 	}
 
 	// Parse end parameter
 	endTime := defaultEnd
 	if endStr := query.Get("end"); endStr != "" {
-		if parsedEnd, err := time.Parse(time.RFC3339, endStr); err == nil {
-			endTime = parsedEnd
-		} else if parsedEnd, err := time.Parse("2006-01-02", endStr); err == nil {
-			// For date-only format, set to end of day in database timezone
-			endTime = time.Date(parsedEnd.Year(), parsedEnd.Month(), parsedEnd.Day(), 23, 59, 59, 999999999, e.dbLocation)
-		} else {
-			return time.Time{}, time.Time{}, errors.New("invalid end time format, use RFC3339 (2006-01-02T15:04:05Z) or date format (2006-01-02)")
+		parsedEnd, ok := e.parseTimeParam(endStr, now, true)
+		if !ok {
+			return time.Time{}, time.Time{}, errors.New("invalid end time format, " + timeFormatsHelp)
 		}
+		endTime = parsedEnd
 	}
 
 	// Ensure start is before end
@@ -217,9 +962,85 @@ func (e *DelProExporter) parseTimeRangeWithLocation(r *http.Request) (time.Time,
 		return time.Time{}, time.Time{}, errors.New("start time must be before end time")
 	}
 
+	if err := e.checkRange(endTime.Sub(startTime)); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+
 	return startTime, endTime, nil
 }
 
+// checkRange rejects time ranges longer than the historical maximum, preventing accidental requests spanning years of data
+func (e *DelProExporter) checkRange(d time.Duration) error {
+	if e.maxRange > 0 && d > e.maxRange {
+		return fmt.Errorf("time range %s exceeds the maximum of %s, split the request into smaller ranges", d, e.maxRange)
+	}
+	return nil
+}
+
+// maxClockSkew is the tolerated difference between client and exporter clocks for start times after now
+const maxClockSkew = 5 * time.Minute
+
+// timeFormatsHelp lists the time formats accepted by parseTimeParam
+const timeFormatsHelp = "use RFC3339 (2006-01-02T15:04:05Z), date format (2006-01-02), Unix timestamp in seconds or milliseconds, or relative time (now, now-7d, now-12h)"
+
+// unixMillisThreshold separates Unix timestamps in seconds from timestamps in milliseconds
+// Values from 1e11 on are milliseconds, as seconds would be beyond year 5000
+const unixMillisThreshold = 1e11
+
+// relativeTimePattern matches Grafana-style relative times such as now, now-7d or now-12h
+var relativeTimePattern = regexp.MustCompile(`^now(?:([+-])([0-9]+)([smhdw]))?$`)
+
+// relativeTimeUnits maps relative time units to their duration
+var relativeTimeUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+	"d": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour,
+}
+
+// parseTimeParam parses a time query parameter relative to now
+// Date-only values are interpreted in the output timezone, at the start of the day or at its end if endOfDay is set
+func (e *DelProExporter) parseTimeParam(value string, now time.Time, endOfDay bool) (time.Time, bool) {
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, true
+	}
+
+	if epoch, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if epoch < 0 {
+			return time.Time{}, false
+		}
+		if epoch >= unixMillisThreshold {
+			return time.UnixMilli(epoch), true
+		}
+		return time.Unix(epoch, 0), true
+	}
+
+	if parsed, err := time.Parse("2006-01-02", value); err == nil {
+		if endOfDay {
+			return time.Date(parsed.Year(), parsed.Month(), parsed.Day(), 23, 59, 59, 999999999, e.outputTZ), true
+		}
+		return time.Date(parsed.Year(), parsed.Month(), parsed.Day(), 0, 0, 0, 0, e.outputTZ), true
+	}
+
+	if m := relativeTimePattern.FindStringSubmatch(value); m != nil {
+		if m[1] == "" {
+			return now, true
+		}
+		amount, err := strconv.ParseInt(m[2], 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		offset := time.Duration(amount) * relativeTimeUnits[m[3]]
+		if m[1] == "-" {
+			offset = -offset
+		}
+		return now.Add(offset), true
+	}
+
+	return time.Time{}, false
+}
+
 // parseOIDRange parses start and optional end OID from HTTP request query parameters
 func parseOIDRange(r *http.Request) (int64, int64, error) {
 	query := r.URL.Query()
@@ -252,12 +1073,42 @@ func parseOIDRange(r *http.Request) (int64, int64, error) {
 	return startOID, endOID, nil
 }
 
+// parseLimit parses the optional limit parameter, the maximum number of records of a historical request
+func parseLimit(r *http.Request) (int, error) {
+	limitStr := r.URL.Query().Get("limit")
+	if limitStr == "" {
+		return 0, nil
+	}
+
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit <= 0 {
+		return 0, errors.New("invalid limit, must be a positive integer")
+	}
+	return limit, nil
+}
+
 // loadLastOID loads the last processed OID from file
+// The first line holds the global OID, following `<device_id> <oid>` lines hold per-device watermarks
 func (e *DelProExporter) loadLastOID() {
-	if data, err := os.ReadFile(e.oidFile); err == nil {
-		if oid, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil {
-			e.lastOID = oid
-			log.Printf("Loaded last processed OID: %d", e.lastOID)
+	data, err := os.ReadFile(e.oidFile)
+	if err != nil {
+		return
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if oid, err := strconv.ParseInt(strings.TrimSpace(lines[0]), 10, 64); err == nil {
+		e.lastOID = oid
+		log.Printf("Loaded last processed OID: %d", e.lastOID)
+	}
+
+	for _, line := range lines[1:] {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		if oid, err := strconv.ParseInt(fields[1], 10, 64); err == nil {
+			e.deviceOIDs[fields[0]] = oid
+			log.Printf("Loaded last processed OID for device %s: %d", fields[0], oid)
 		}
 	}
 }
@@ -265,6 +1116,11 @@ func (e *DelProExporter) loadLastOID() {
 // saveLastOID saves the last processed OID to file
 func (e *DelProExporter) saveLastOID() {
 	data := strconv.FormatInt(e.lastOID, 10)
+	if e.perDevice {
+		for _, device := range slices.Sorted(maps.Keys(e.deviceOIDs)) {
+			data += fmt.Sprintf("\n%s %d", device, e.deviceOIDs[device])
+		}
+	}
 	if err := os.WriteFile(e.oidFile, []byte(data), 0644); err != nil {
 		log.Printf("Failed to save last OID: %v", err)
 	}
@@ -272,6 +1128,14 @@ func (e *DelProExporter) saveLastOID() {
 
 // SetLastOID sets the last processed OID if the new value is larger than current
 func (e *DelProExporter) SetLastOID(newOID int64) {
+	e.updateMu.Lock()
+	defer e.updateMu.Unlock()
+
+	e.setLastOIDLocked(newOID)
+}
+
+// setLastOIDLocked sets the last processed OID if the new value is larger than current, the caller holding updateMu
+func (e *DelProExporter) setLastOIDLocked(newOID int64) {
 	if newOID > e.lastOID {
 		log.Printf("Overriding last processed OID from %d to %d", e.lastOID, newOID)
 		e.lastOID = newOID
@@ -281,17 +1145,35 @@ func (e *DelProExporter) SetLastOID(newOID int64) {
 	}
 }
 
-// initializeCounters sets all counters to 0 for animals that have milked in the past 24h
-func (e *DelProExporter) initializeCounters() {
-	log.Printf("Initializing counters for animals from past 24h...")
+// recoverLastOID advances the last processed OID to the highest OID in the database, so that a lost OID file
+// does not turn the whole lookback window into counter increments
+// It is called while connecting, with updateMu held
+func (e *DelProExporter) recoverLastOID(db *database.Client) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	maxOID, err := db.GetMaxOID(ctx)
+	if err != nil {
+		log.Printf("Unable to recover last processed OID from database: %v", err)
+		return
+	}
+	log.Printf("Recovering last processed OID from database")
+	e.setLastOIDLocked(maxOID)
+}
+
+// initializeCounters sets all counters to 0 for animals that have milked within the live lookback window
+func (e *DelProExporter) initializeCounters(db *database.Client) {
+	log.Printf("Initializing counters for animals from past %s...", e.lookbackWindow)
 
 	// Create context with timeout for database operations
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	// Query last 24h of records to get all animals that might need initialization
-	now := time.Now()
-	records, err := e.db.GetMilkingRecords(ctx, now.Add(-24*time.Hour), now, 0)
+	// Query the lookback window to get all animals that might need initialization
+	// Use the same delayed window as live updates, so that animals whose only session falls within
+	// the delay are not initialized to zero before their session can be processed
+	now := time.Now().Add(-models.LiveDelay)
+	records, err := db.GetMilkingRecords(ctx, now.Add(-e.lookbackWindow), now, 0)
 	if err != nil {
 		log.Printf("Error getting records for counter initialization: %v", err)
 		return
@@ -303,7 +1185,7 @@ func (e *DelProExporter) initializeCounters() {
 
 	for _, record := range records {
 		// Create a unique key for this animal's metric labels
-		key := record.LabelStr()
+		key := e.metrics.Naming().RecordLabels(record)
 
 		if !seenAnimals[key] {
 			// Initialize all counter metrics to 0 for this animal
@@ -312,11 +1194,156 @@ func (e *DelProExporter) initializeCounters() {
 			initializedCount++
 		}
 	}
+	e.markAnimalsSeen(records)
 
-	log.Printf("Initialized counters for %d unique animals from past 24h", initializedCount)
+	log.Printf("Initialized counters for %d unique animals from past %s", initializedCount, e.lookbackWindow)
+}
+
+// WriteQueries writes the SQL queries run against the database, with their parameter placeholders
+func (e *DelProExporter) WriteQueries(w io.Writer) {
+	db := e.db.Load()
+	if db == nil {
+		fmt.Fprintf(w, "-- %v\n", errDBUnavailable)
+		return
+	}
+	for _, q := range db.Queries() {
+		fmt.Fprintf(w, "-- %s\n%s;\n\n", q.Name, strings.TrimSpace(q.SQL))
+	}
 }
 
-// WritePrometheus writes current metrics in standard Prometheus format
+// WritePrometheus writes current metrics in standard Prometheus format, with help and type of DelPro metric families
 func (e *DelProExporter) WritePrometheus(w io.Writer, exposeProcessMetrics bool) {
-	metrics.WritePrometheus(w, exposeProcessMetrics)
+	mw := delprometrics.NewMetadataWriter(w, e.metrics.Naming())
+	defer func() {
+		if err := mw.Flush(); err != nil {
+			log.Printf("Error writing metrics metadata: %v", err)
+		}
+	}()
+
+	set := e.metrics.Set()
+	if set == metrics.GetDefaultSet() {
+		metrics.WritePrometheus(mw, exposeProcessMetrics)
+		return
+	}
+
+	set.WritePrometheus(mw)
+	if exposeProcessMetrics {
+		metrics.WriteProcessMetrics(mw)
+	}
+}
+
+// WriteCurrentMetrics writes current metrics, restricted to the metric families selected with match[] parameters
+func (e *DelProExporter) WriteCurrentMetrics(r *http.Request, w http.ResponseWriter) {
+	names, err := parseMatchers(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if e.collectOnScrape {
+		e.collectIfStale()
+	}
+
+	writer, closeWriter := compressedWriter(r, w)
+	defer closeWriter()
+
+	if err := e.writeLiveMetrics(writer, names); err != nil {
+		log.Printf("Error writing current metrics: %v", err)
+	}
+}
+
+// writeLiveMetrics writes current metrics with the configured output conversions, restricted to the given
+// metric families when names is not empty
+func (e *DelProExporter) writeLiveMetrics(w io.Writer, names map[string]bool) error {
+	// Writers converting the Prometheus output, flushed in order once done
+	var flushers []interface{ Flush() error }
+	if e.valuePrecision >= 0 {
+		pw := delprometrics.NewPrecisionWriter(w, e.valuePrecision)
+		w = pw
+		flushers = append(flushers, pw)
+	}
+	if e.sourceLabel {
+		lw := delprometrics.NewLabelWriter(w, fmt.Sprintf("source=%q", sourceLive))
+		w = lw
+		flushers = append(flushers, lw)
+	}
+	if len(names) > 0 {
+		fw := delprometrics.NewFilterWriter(w, names)
+		w = fw
+		flushers = append(flushers, fw)
+	}
+
+	e.WritePrometheus(w, false)
+
+	var err error
+	for _, f := range slices.Backward(flushers) {
+		if flushErr := f.Flush(); err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// Naming returns the label and name options of exposed metrics
+func (e *DelProExporter) Naming() models.Naming {
+	return e.metrics.Naming()
+}
+
+// Collector returns a prometheus.Collector of the current metrics, collected first in collect-on-scrape mode
+// Duration histograms must use the Prometheus format
+func (e *DelProExporter) Collector() prometheus.Collector {
+	return delprometrics.NewCollector(func(w io.Writer) error {
+		if e.collectOnScrape {
+			e.collectIfStale()
+		}
+		return e.writeLiveMetrics(w, nil)
+	})
+}
+
+// pushOTLP pushes the current metrics to the OTLP endpoint
+func (e *DelProExporter) pushOTLP() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := e.otlp.Push(ctx); err != nil {
+		log.Printf("Error pushing OTLP metrics: %v", err)
+	}
+}
+
+// parseMatchers parses federation-style match[] parameters into a set of metric names
+// Supported forms are `metric_name`, `metric_name{}` and `{__name__="metric_name"}`, label matchers are rejected
+// rather than silently ignored, as filtering is done on metric names only
+func parseMatchers(r *http.Request) (map[string]bool, error) {
+	names := make(map[string]bool)
+
+	for _, matcher := range r.URL.Query()["match[]"] {
+		matcher = strings.TrimSpace(matcher)
+
+		name, selector, hasSelector := strings.Cut(matcher, "{")
+		if hasSelector {
+			selector, found := strings.CutSuffix(selector, "}")
+			if !found {
+				return nil, fmt.Errorf("invalid match[] parameter %q, unterminated label selector", matcher)
+			}
+			for cond := range strings.SplitSeq(selector, ",") {
+				cond = strings.TrimSpace(cond)
+				if cond == "" {
+					continue
+				}
+				value, found := strings.CutPrefix(cond, "__name__=")
+				if !found || name != "" {
+					return nil, fmt.Errorf("invalid match[] parameter %q, only metric names are supported, not label matchers", matcher)
+				}
+				name = strings.Trim(value, `"`)
+			}
+		}
+		name = strings.TrimSpace(name)
+
+		if name == "" {
+			return nil, errors.New("invalid match[] parameter, a metric name is required")
+		}
+		names[name] = true
+	}
+
+	return names, nil
 }
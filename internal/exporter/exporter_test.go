@@ -0,0 +1,1457 @@
+package exporter
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/clementnuss/delpro-exporter/internal/database"
+	"github.com/clementnuss/delpro-exporter/internal/models"
+	"github.com/klauspost/compress/zstd"
+)
+
+// newTestExporter creates an exporter with an isolated metric set and OID file, whose database is unreachable
+func newTestExporter(t *testing.T, cfg Config) *DelProExporter {
+	t.Helper()
+	cfg.IsolatedSet = true
+	cfg.Database = database.Config{
+		Host:           "127.0.0.1",
+		Port:           "1",
+		Location:       time.UTC,
+		ConnectRetries: 1,
+		ConnectBackoff: time.Millisecond,
+	}
+	if cfg.Metrics.Location == nil {
+		cfg.Metrics.Location = time.UTC
+	}
+
+	e := NewDelProExporter(cfg)
+	e.oidFile = filepath.Join(t.TempDir(), "delpro_last_oid.txt")
+	return e
+}
+
+// useMockDB makes the exporter connect to a mock database, on which unexpected queries fail
+func useMockDB(t *testing.T, e *DelProExporter) sqlmock.Sqlmock {
+	t.Helper()
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mock.MatchExpectationsInOrder(false)
+	t.Cleanup(func() { db.Close() })
+
+	e.newClient = func(cfg database.Config) (*database.Client, error) {
+		return database.NewClientWithDB(db, cfg), nil
+	}
+	return mock
+}
+
+// currentMetrics returns the /metrics output of an exporter
+func currentMetrics(t *testing.T, e *DelProExporter) string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	e.WriteCurrentMetrics(httptest.NewRequest("GET", "/metrics", nil), rec)
+	return rec.Body.String()
+}
+
+func TestNewDelProExporterDoesNotConnect(t *testing.T) {
+	start := time.Now()
+	e := newTestExporter(t, Config{})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("NewDelProExporter took %s, it must not wait for the database", elapsed)
+	}
+
+	if e.db.Load() != nil {
+		t.Fatal("database connected at creation")
+	}
+	if output := currentMetrics(t, e); !regexp.MustCompile(`(?m)^delpro_db_connected(\{[^}]*\})? 0$`).MatchString(output) {
+		t.Fatalf("delpro_db_connected 0 missing from metrics before the first update:\n%s", output)
+	}
+}
+
+func TestUpdateMetricsRecoversOIDWithoutDeadlock(t *testing.T) {
+	e := newTestExporter(t, Config{RecoverOIDFromDB: true})
+	mock := useMockDB(t, e)
+	mock.ExpectQuery(`MAX\(OID\)`).WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(int64(42)))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.UpdateMetrics()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("UpdateMetrics did not return, recovering the last OID deadlocked")
+	}
+
+	e.updateMu.Lock()
+	defer e.updateMu.Unlock()
+	if e.lastOID != 42 {
+		t.Fatalf("last OID = %d, want 42 recovered from the database", e.lastOID)
+	}
+}
+
+// TestConcurrentUpdates runs updates, OID overrides, catch-ups and scrapes concurrently, for go test -race
+func TestConcurrentUpdates(t *testing.T) {
+	e := newTestExporter(t, Config{PerDeviceWatermark: true, StaleAnimalAfter: time.Hour})
+	useMockDB(t, e)
+
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			e.UpdateMetrics()
+		}()
+		go func() {
+			defer wg.Done()
+			e.SetLastOID(int64(100 + i))
+		}()
+		go func() {
+			defer wg.Done()
+			e.CatchUp(context.Background(), 0)
+		}()
+		go func() {
+			defer wg.Done()
+			currentMetrics(t, e)
+		}()
+	}
+	wg.Wait()
+
+	if e.lastOID != 103 {
+		t.Fatalf("last OID = %d, want the highest override 103", e.lastOID)
+	}
+}
+
+// milkingColumns are the columns of the milking records query, in scan order
+var milkingColumns = []string{
+	"OID", "animal_number", "animal_name", "animal_reg_no", "breed_name", "breed_id", "device", "destination",
+	"lactation_number", "days_in_lactation", "lactation_yield", "yield", "conductivity", "temperature", "duration",
+	"scc", "incomplete", "kickoff", "manual_attach",
+	"yield_lf", "yield_lr", "yield_rf", "yield_rr", "peak_flow_lf", "peak_flow_lr", "peak_flow_rf", "peak_flow_rr",
+	"begin_time", "end_time",
+}
+
+// milkingRows returns milking records query rows of animal 1, one per OID, optional columns being NULL
+func milkingRows(oids ...int64) *sqlmock.Rows {
+	rows := sqlmock.NewRows(milkingColumns)
+	for _, oid := range oids {
+		end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC).Add(time.Duration(oid) * time.Hour)
+		rows.AddRow(
+			oid, "1", "Bella", "CH1", "Holstein Friesian", "1", "1", "Tank",
+			nil, nil, nil, 12.5, nil, nil, nil,
+			nil, nil, nil, nil,
+			nil, nil, nil, nil, nil, nil, nil, nil,
+			end.Add(-8*time.Minute), end,
+		)
+	}
+	return rows
+}
+
+// connectMockDB connects the exporter to a mock database, on which unexpected queries fail
+func connectMockDB(t *testing.T, e *DelProExporter) sqlmock.Sqlmock {
+	t.Helper()
+	mock := useMockDB(t, e)
+	db, err := e.newClient(e.dbConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.db.Store(db)
+	return mock
+}
+
+func TestCatchUpOnlyCountsUncountedRecordsOnce(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	mock := connectMockDB(t, e)
+	// Records up to OID 10 precede the connection and those up to OID 14 end before the first live window
+	e.lastOID = 20
+	e.startupOID = 10
+	e.caughtUpFrom, e.caughtUpTo = 10, 10
+	e.liveStart = time.Date(2024, 5, 1, 21, 0, 0, 0, time.UTC)
+
+	mock.ExpectQuery(`FROM`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sql.Named("StartOID", int64(5)), sql.Named("EndOID", int64(10))).
+		WillReturnRows(milkingRows(6, 7, 8, 9, 10))
+	mock.ExpectQuery(`FROM`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sql.Named("StartOID", int64(10)), sql.Named("EndOID", int64(20))).
+		WillReturnRows(milkingRows(11, 12, 13, 14, 15, 16, 17, 18, 19, 20))
+
+	for i, want := range []int{9, 0} {
+		count, err := e.CatchUp(context.Background(), 5)
+		if err != nil {
+			t.Fatalf("catch-up %d: %v", i, err)
+		}
+		if count != want {
+			t.Errorf("catch-up %d counted %d records, want %d", i, count, want)
+		}
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	output := currentMetrics(t, e)
+	if !regexp.MustCompile(`(?m)^delpro_milk_sessions_total\{[^}]*\} 9$`).MatchString(output) {
+		t.Errorf("sessions counter not incremented once per uncounted record:\n%s", output)
+	}
+	if strings.Contains(output, "delpro_milk_last_yield") {
+		t.Errorf("catch-up set the last yield gauges:\n%s", output)
+	}
+	if e.lastOID != 20 {
+		t.Errorf("last OID = %d, want it unchanged", e.lastOID)
+	}
+}
+
+func TestHistoricalPagingResumesFromCursor(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	mock := connectMockDB(t, e)
+	mock.MatchExpectationsInOrder(true)
+	mock.ExpectQuery(`SELECT TOP \(@Limit\)`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sql.Named("StartOID", int64(0)), sql.Named("Limit", 2)).
+		WillReturnRows(milkingRows(10, 11))
+	mock.ExpectQuery(`SELECT TOP \(@Limit\)`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sql.Named("StartOID", int64(11)), sql.Named("Limit", 2)).
+		WillReturnRows(milkingRows(12))
+
+	var cursors []string
+	startOID := "0"
+	for range 3 {
+		rec := httptest.NewRecorder()
+		e.WriteHistoricalMetrics(httptest.NewRequest("GET", "/historical-metrics?range_mode=oid&limit=2&start_oid="+startOID, nil), rec)
+		if rec.Code != 200 {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+
+		startOID = rec.Header().Get("X-Next-OID")
+		cursors = append(cursors, startOID)
+		if startOID == "" {
+			break
+		}
+	}
+
+	if len(cursors) != 2 || cursors[0] != "11" || cursors[1] != "" {
+		t.Fatalf("cursors = %q, want a cursor of 11 after the full first page and none after the last page", cursors)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOIDRangeModeRequiresLimitWithMaxRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxRange time.Duration
+		query    string
+		want     int
+	}{
+		{"unlimited without limit", 0, "start_oid=0&range_mode=oid", 200},
+		{"limited without limit", 24 * time.Hour, "start_oid=0&range_mode=oid", 400},
+		{"limited with limit", 24 * time.Hour, "start_oid=0&range_mode=oid&limit=100", 200},
+		{"limited with oversized limit", 24 * time.Hour, "start_oid=0&range_mode=oid&limit=10001", 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExporter(t, Config{HistoricalMaxRange: tt.maxRange})
+			mock := connectMockDB(t, e)
+			mock.ExpectQuery(`FROM`).WillReturnRows(milkingRows(1))
+
+			rec := httptest.NewRecorder()
+			e.WriteHistoricalMetrics(httptest.NewRequest("GET", "/historical-metrics?"+tt.query, nil), rec)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestConcurrentScrapesShareCollection(t *testing.T) {
+	e := newTestExporter(t, Config{CollectOnScrape: true, MinCollectInterval: time.Hour})
+	// Every collection tries to connect, as the database stays unreachable
+	var connects atomic.Int32
+	e.newClient = func(database.Config) (*database.Client, error) {
+		connects.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		return nil, errors.New("database unreachable")
+	}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			currentMetrics(t, e)
+		}()
+	}
+	wg.Wait()
+	// Scrapes within the minimum collect interval reuse the previous result
+	currentMetrics(t, e)
+
+	if n := connects.Load(); n != 1 {
+		t.Fatalf("scrapes queried the database %d times, want 1", n)
+	}
+}
+
+func TestStatsWindowMaxRange(t *testing.T) {
+	tests := []struct {
+		window string
+		want   int
+	}{
+		{"24h", 200},
+		{"48h", 400},
+		{"8760h", 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.window, func(t *testing.T) {
+			e := newTestExporter(t, Config{HistoricalMaxRange: 24 * time.Hour})
+			mock := connectMockDB(t, e)
+			mock.ExpectQuery(`FROM`).WillReturnRows(milkingRows(1))
+
+			rec := httptest.NewRecorder()
+			e.WriteStats(httptest.NewRequest("GET", "/stats?window="+tt.window, nil), rec)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestRemoveStaleAnimals(t *testing.T) {
+	e := newTestExporter(t, Config{StaleAnimalAfter: 24 * time.Hour})
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	// Both animals lack a registration number, which DelPro reports as Unknown
+	stale := func(oid int64, end time.Time) *models.MilkingRecord {
+		return &models.MilkingRecord{OID: oid, AnimalNumber: "1", AnimalRegNo: "Unknown", DeviceID: "1", Yield: 10, EndTime: end}
+	}
+	active := &models.MilkingRecord{OID: 3, AnimalNumber: "2", AnimalRegNo: "Unknown", DeviceID: "1", Yield: 12, EndTime: now.Add(-time.Hour)}
+	records := []*models.MilkingRecord{stale(1, now.Add(-60*time.Hour)), stale(2, now.Add(-48*time.Hour)), active}
+	e.metrics.CreateMetricsFromRecords(records)
+	e.markAnimalsSeen(records)
+	e.removeStaleAnimals(now)
+
+	output := currentMetrics(t, e)
+	if strings.Contains(output, `animal_number="1"`) {
+		t.Errorf("series of the stale animal not removed:\n%s", output)
+	}
+	if !strings.Contains(output, `delpro_milk_sessions_total{animal_number="2"`) {
+		t.Errorf("series of the active animal sharing its registration number removed:\n%s", output)
+	}
+
+	// A returning animal counts its sessions from zero again
+	e.metrics.CreateMetricsFromRecords([]*models.MilkingRecord{stale(4, now)})
+	output = currentMetrics(t, e)
+	if !regexp.MustCompile(`(?m)^delpro_milk_sessions_total\{animal_number="1",[^}]*\} 1$`).MatchString(output) {
+		t.Errorf("sessions counter of the returning animal did not restart:\n%s", output)
+	}
+}
+
+func TestTimeRangeMaxRange(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		ok    bool
+	}{
+		{"default start clamped", "", true},
+		{"within limit", "?start=now-12h", true},
+		{"at limit", "?start=now-24h", true},
+		{"over limit", "?start=now-48h", false},
+		{"over limit with end", "?start=2024-05-01&end=2024-05-03", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The default lookback is longer than the maximum range
+			e := newTestExporter(t, Config{HistoricalMaxRange: 24 * time.Hour, HistoricalLookback: 72 * time.Hour})
+			start, end, err := e.parseTimeRangeWithLocation(httptest.NewRequest("GET", "/metrics/historical"+tt.query, nil))
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok %v", err, tt.ok)
+			}
+			if err == nil && end.Sub(start) > 24*time.Hour {
+				t.Errorf("range = %s, want at most 24h", end.Sub(start))
+			}
+		})
+	}
+}
+
+func TestParseMatchers(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  []string
+		ok    bool
+	}{
+		{"none", "", nil, true},
+		{"single", "match[]=delpro_milk_sessions_total", []string{"delpro_milk_sessions_total"}, true},
+		{"multiple", "match[]=delpro_milk_sessions_total&match[]=delpro_milk_yield_liters_total", []string{"delpro_milk_sessions_total", "delpro_milk_yield_liters_total"}, true},
+		{"empty selector", "match[]=delpro_milk_sessions_total{}", []string{"delpro_milk_sessions_total"}, true},
+		{"name matcher", `match[]={__name__="delpro_milk_sessions_total"}`, []string{"delpro_milk_sessions_total"}, true},
+		{"label matcher", `match[]=delpro_milk_sessions_total{animal_number="1"}`, nil, false},
+		{"name and label matchers", `match[]={__name__="delpro_milk_sessions_total",device="1"}`, nil, false},
+		{"unterminated selector", "match[]=delpro_milk_sessions_total{", nil, false},
+		{"missing name", `match[]={device="1"}`, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/metrics", nil)
+			r.URL.RawQuery = tt.query
+			names, err := parseMatchers(r)
+			if (err == nil) != tt.ok {
+				t.Fatalf("err = %v, want ok %v", err, tt.ok)
+			}
+			if len(names) != len(tt.want) {
+				t.Fatalf("names = %v, want %v", names, tt.want)
+			}
+			for _, name := range tt.want {
+				if !names[name] {
+					t.Errorf("names = %v, missing %s", names, name)
+				}
+			}
+		})
+	}
+}
+
+func TestCurrentMetricsRejectsLabelMatchers(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.URL.RawQuery = `match[]=delpro_milk_sessions_total{animal_number="1"}`
+	rec := httptest.NewRecorder()
+	e.WriteCurrentMetrics(r, rec)
+	if rec.Code != 400 {
+		t.Fatalf("status = %d, want 400", rec.Code)
+	}
+}
+
+func TestCompressedWriter(t *testing.T) {
+	const body = "delpro_milk_sessions_total{animal_number=\"1\"} 3\n"
+
+	tests := []struct {
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{"zstd", "zstd"},
+		{"gzip, zstd", "zstd"},
+		{"gzip", "gzip"},
+		{"zstd;q=0, gzip", "gzip"},
+		{"", ""},
+		{"br", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			// Pooled encoders are reused by later responses
+			for range 2 {
+				r := httptest.NewRequest("GET", "/metrics", nil)
+				r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+				rec := httptest.NewRecorder()
+				w, closeWriter := compressedWriter(r, rec)
+				if _, err := io.WriteString(w, body); err != nil {
+					t.Fatal(err)
+				}
+				if err := closeWriter(); err != nil {
+					t.Fatal(err)
+				}
+
+				if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+					t.Fatalf("Content-Encoding = %q, want %q", got, tt.wantEncoding)
+				}
+				var reader io.Reader = rec.Body
+				switch tt.wantEncoding {
+				case "zstd":
+					decoder, err := zstd.NewReader(rec.Body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					defer decoder.Close()
+					reader = decoder
+				case "gzip":
+					decoder, err := gzip.NewReader(rec.Body)
+					if err != nil {
+						t.Fatal(err)
+					}
+					reader = decoder
+				}
+				got, err := io.ReadAll(reader)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(got) != body {
+					t.Errorf("body = %q, want %q", got, body)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateMetricsPushesOTLP(t *testing.T) {
+	type request struct {
+		locked bool
+		body   map[string]any
+	}
+	requests := make(chan request, 1)
+
+	var e *DelProExporter
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The update lock is released before pushing
+		locked := !e.updateMu.TryLock()
+		if !locked {
+			e.updateMu.Unlock()
+		}
+		var body map[string]any
+		if r.Header.Get("Content-Type") != "application/json" || json.NewDecoder(r.Body).Decode(&body) != nil {
+			http.Error(w, "invalid OTLP request", http.StatusBadRequest)
+		}
+		requests <- request{locked: locked, body: body}
+	}))
+	defer receiver.Close()
+
+	e = newTestExporter(t, Config{OTLPEndpoint: receiver.URL + "/v1/metrics"})
+	useMockDB(t, e)
+	e.UpdateMetrics()
+
+	var got request
+	select {
+	case got = <-requests:
+	default:
+		t.Fatal("no OTLP request received after the update")
+	}
+	if got.locked {
+		t.Error("update lock held while pushing")
+	}
+
+	// Metric names per OTLP metric type
+	types := make(map[string]string)
+	for _, rm := range got.body["resourceMetrics"].([]any) {
+		for _, sm := range rm.(map[string]any)["scopeMetrics"].([]any) {
+			for _, m := range sm.(map[string]any)["metrics"].([]any) {
+				metric := m.(map[string]any)
+				for _, kind := range []string{"gauge", "sum", "histogram"} {
+					if metric[kind] != nil {
+						types[metric["name"].(string)] = kind
+					}
+				}
+			}
+		}
+	}
+	for name, kind := range map[string]string{
+		models.MetricExporterInfo:      "gauge",
+		models.MetricExporterHeartbeat: "gauge",
+		models.MetricUpdateDuration:    "histogram",
+	} {
+		if types[name] != kind {
+			t.Errorf("metric %s pushed as %q, want %s", name, types[name], kind)
+		}
+	}
+}
+
+func TestStatsDefaultWindow(t *testing.T) {
+	e := newTestExporter(t, Config{LookbackWindow: 6 * time.Hour})
+	mock := connectMockDB(t, e)
+	mock.ExpectQuery(`FROM`).WillReturnRows(milkingRows(1))
+
+	rec := httptest.NewRecorder()
+	e.WriteStats(httptest.NewRequest("GET", "/stats", nil), rec)
+	var stats models.HerdStats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if window := stats.End.Sub(stats.Start); window != 6*time.Hour {
+		t.Errorf("window = %s, want the 6h lookback window", window)
+	}
+}
+
+func TestCurrentMetricsMatchers(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	e.metrics.CreateMetricsFromRecords([]*models.MilkingRecord{
+		{OID: 1, AnimalNumber: "1", AnimalRegNo: "CH1", DeviceID: "1", Yield: 12.5, EndTime: time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)},
+	})
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"match[]=delpro_milk_sessions_total", []string{"delpro_milk_sessions_total"}},
+		{"match[]=delpro_milk_sessions_total&match[]=delpro_milk_yield_liters_total", []string{"delpro_milk_sessions_total", "delpro_milk_yield_liters_total"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			e.WriteCurrentMetrics(httptest.NewRequest("GET", "/metrics?"+tt.query, nil), rec)
+
+			families := make(map[string]bool)
+			for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+				if !strings.HasPrefix(line, "#") {
+					families[strings.FieldsFunc(line, func(r rune) bool { return r == '{' || r == ' ' })[0]] = true
+				}
+			}
+			if len(families) != len(tt.want) {
+				t.Errorf("families %v, want %v", families, tt.want)
+			}
+			for _, name := range tt.want {
+				if !families[name] {
+					t.Errorf("families %v, missing %s", families, name)
+				}
+			}
+		})
+	}
+}
+
+// failingResponseWriter fails the first write going past limit bytes, as a dropped connection would
+type failingResponseWriter struct {
+	*httptest.ResponseRecorder
+	limit  int
+	failed bool
+}
+
+func (w *failingResponseWriter) Write(p []byte) (int, error) {
+	if !w.failed && w.Body.Len()+len(p) > w.limit {
+		w.failed = true
+		return 0, errors.New("connection reset")
+	}
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestHistoricalMetricsPartialFailures(t *testing.T) {
+	const url = "/historical-metrics?start=2024-05-01&end=2024-05-02"
+
+	t.Run("rows error before streaming", func(t *testing.T) {
+		e := newTestExporter(t, Config{})
+		mock := connectMockDB(t, e)
+		mock.ExpectQuery(`FROM`).WillReturnRows(milkingRows(1, 2, 3).RowError(1, errors.New("connection reset")))
+
+		rec := httptest.NewRecorder()
+		e.WriteHistoricalMetrics(httptest.NewRequest("GET", url, nil), rec)
+		if rec.Code != 500 {
+			t.Fatalf("status = %d, want 500", rec.Code)
+		}
+		if strings.Contains(rec.Body.String(), "delpro_") {
+			t.Errorf("partial records streamed:\n%s", rec.Body.String())
+		}
+	})
+
+	t.Run("write error while streaming", func(t *testing.T) {
+		e := newTestExporter(t, Config{})
+		mock := connectMockDB(t, e)
+		mock.ExpectQuery(`FROM`).WillReturnRows(milkingRows(1, 2, 3))
+
+		w := &failingResponseWriter{ResponseRecorder: httptest.NewRecorder(), limit: 100}
+		e.WriteHistoricalMetrics(httptest.NewRequest("GET", url, nil), w)
+		if w.Code != 200 {
+			t.Fatalf("status = %d, want 200 sent before the failure", w.Code)
+		}
+		if !strings.HasSuffix(w.Body.String(), "# ERROR: historical export incomplete: connection reset\n") {
+			t.Errorf("body does not end with the error marker:\n%s", w.Body.String())
+		}
+		if trailer := w.Result().Trailer.Get(streamErrorTrailer); trailer != "connection reset" {
+			t.Errorf("trailer %s = %q, want connection reset", streamErrorTrailer, trailer)
+		}
+	})
+}
+
+// expectSuccessfulUpdate expects the queries of a metrics update once connected, returning the given milking rows
+func expectSuccessfulUpdate(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	mock.ExpectQuery(`ORDER BY smy\.OID`).WillReturnRows(rows)
+	mock.ExpectQuery(`GROUP BY smy\.MilkingDevice`).
+		WillReturnRows(sqlmock.NewRows([]string{"device", "sessions", "incomplete"}).AddRow("1", int64(10), int64(1)))
+	mock.ExpectQuery(`COUNT_BIG`).WillReturnRows(sqlmock.NewRows([]string{"total"}).AddRow(int64(100)))
+}
+
+func TestReadyAfterFirstSuccessfulUpdate(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	mock := useMockDB(t, e)
+	if e.Ready() {
+		t.Fatal("ready before the first update")
+	}
+
+	// A failed update leaves the exporter not ready
+	e.UpdateMetrics()
+	if e.Ready() {
+		t.Fatal("ready after a failed update")
+	}
+
+	expectSuccessfulUpdate(mock, milkingRows(1))
+	e.UpdateMetrics()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	if !e.Ready() {
+		t.Fatal("not ready after a successful update")
+	}
+}
+
+func TestUpdateMetricsSurvivesUtilizationFailure(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	mock := useMockDB(t, e)
+	// Counters are initialized from the lookback window on connection, before the live query
+	mock.ExpectQuery(`ORDER BY smy\.OID`).WillReturnRows(milkingRows(1, 2))
+	mock.ExpectQuery(`ORDER BY smy\.OID`).WillReturnRows(milkingRows(1, 2))
+	mock.ExpectQuery(`GROUP BY smy\.MilkingDevice`).WillReturnError(errors.New("deadlock victim"))
+	mock.ExpectQuery(`COUNT_BIG`).WillReturnRows(sqlmock.NewRows([]string{"total"}).AddRow(int64(100)))
+
+	e.UpdateMetrics()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	if e.lastOID != 2 {
+		t.Errorf("last OID = %d, want 2 from the milking records", e.lastOID)
+	}
+	output := currentMetrics(t, e)
+	for _, want := range []string{
+		`(?m)^delpro_milk_sessions_total\{[^}]*\} 2$`,
+		`(?m)^delpro_scrape_success\{collector="utilization"[^}]*\} 0$`,
+		`(?m)^delpro_scrape_success\{collector="milking"[^}]*\} 1$`,
+		`(?m)^delpro_scrape_success\{collector="sessions"[^}]*\} 1$`,
+	} {
+		if !regexp.MustCompile(want).MatchString(output) {
+			t.Errorf("metrics do not match %s:\n%s", want, output)
+		}
+	}
+	if e.Ready() {
+		t.Error("ready after an update with a failed collector")
+	}
+}
+
+func TestWriteQueries(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	var out bytes.Buffer
+	e.WriteQueries(&out)
+	if !strings.Contains(out.String(), errDBUnavailable.Error()) {
+		t.Errorf("queries without database = %q, want unavailable note", out.String())
+	}
+
+	connectMockDB(t, e)
+	out.Reset()
+	e.WriteQueries(&out)
+	for _, want := range []string{
+		"-- milking_records\n", "FROM SessionMilkYield smy", "@StartOID", "ORDER BY smy.OID",
+		"-- device_utilization\n", "GROUP BY smy.MilkingDevice",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("queries lack %q:\n%s", want, out.String())
+		}
+	}
+}
+
+// timeArg matches time query arguments satisfying a condition
+type timeArg func(time.Time) bool
+
+func (match timeArg) Match(v driver.Value) bool {
+	t, ok := v.(time.Time)
+	return ok && match(t)
+}
+
+func TestInitializeCountersSkipsDelayedSessions(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	mock := connectMockDB(t, e)
+
+	// A session ended 2 minutes ago is within the live delay: neither the live update nor the
+	// counter initialization may cover it, otherwise its animal would be initialized but left unprocessed
+	delayed := time.Now().Add(-2 * time.Minute)
+	beforeDelayed := timeArg(func(end time.Time) bool { return end.Before(delayed) })
+	mock.ExpectQuery(`ORDER BY smy\.OID`).
+		WithArgs(sqlmock.AnyArg(), beforeDelayed, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(milkingColumns))
+	mock.ExpectQuery(`ORDER BY smy\.OID`).
+		WithArgs(sqlmock.AnyArg(), beforeDelayed, sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows(milkingColumns))
+
+	db := e.db.Load()
+	e.initializeCounters(db)
+	if err := e.updateMilkingMetrics(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestParseRelativeTime(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"now", now},
+		{"now-7d", now.AddDate(0, 0, -7)},
+		{"now-12h", now.Add(-12 * time.Hour)},
+		{"now-30m", now.Add(-30 * time.Minute)},
+		{"now-90s", now.Add(-90 * time.Second)},
+		{"now-2w", now.AddDate(0, 0, -14)},
+		{"now+1h", now.Add(time.Hour)},
+	}
+	for _, tt := range tests {
+		if got, ok := e.parseTimeParam(tt.value, now, false); !ok || !got.Equal(tt.want) {
+			t.Errorf("parseTimeParam(%q) = %v, %t, want %v", tt.value, got, ok, tt.want)
+		}
+	}
+
+	for _, value := range []string{"now-", "now-7", "now-7y", "now-1.5h", "now - 1h", "NOW", "now-1h-1m", "yesterday"} {
+		if got, ok := e.parseTimeParam(value, now, false); ok {
+			t.Errorf("parseTimeParam(%q) = %v, want invalid", value, got)
+		}
+	}
+}
+
+func TestParseUnixTime(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	now := time.Date(2024, 5, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"1714543200", time.Unix(1714543200, 0)},
+		{"1714543200123", time.UnixMilli(1714543200123)},
+		// Digits only values are epochs, not compact dates
+		{"20240501", time.Unix(20240501, 0)},
+		// Values from 1e11 on are milliseconds
+		{"99999999999", time.Unix(99999999999, 0)},
+		{"100000000000", time.UnixMilli(100000000000)},
+		{"0", time.Unix(0, 0)},
+	}
+	for _, tt := range tests {
+		if got, ok := e.parseTimeParam(tt.value, now, false); !ok || !got.Equal(tt.want) {
+			t.Errorf("parseTimeParam(%q) = %v, %t, want %v", tt.value, got, ok, tt.want)
+		}
+	}
+
+	for _, value := range []string{"-1714543200", "1714543200.5", "1.7e9", "0x6630"} {
+		if got, ok := e.parseTimeParam(value, now, false); ok {
+			t.Errorf("parseTimeParam(%q) = %v, want invalid", value, got)
+		}
+	}
+}
+
+func TestPerDeviceWatermarks(t *testing.T) {
+	e := newTestExporter(t, Config{PerDeviceWatermark: true})
+	mock := connectMockDB(t, e)
+	// Device 1 is reprocessed from OID 5, while device 2 is up to date with the global watermark
+	e.lastOID = 10
+	e.deviceOIDs = map[string]int64{"1": 5, "2": 10}
+
+	rows := sqlmock.NewRows(milkingColumns)
+	for _, session := range []struct {
+		oid    int64
+		device string
+	}{{6, "1"}, {8, "2"}, {11, "1"}, {12, "2"}} {
+		end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC).Add(time.Duration(session.oid) * time.Hour)
+		rows.AddRow(
+			session.oid, "1", "Bella", "CH1", "Holstein Friesian", "1", session.device, "Tank",
+			nil, nil, nil, 12.5, nil, nil, nil,
+			nil, nil, nil, nil,
+			nil, nil, nil, nil, nil, nil, nil, nil,
+			end.Add(-8*time.Minute), end,
+		)
+	}
+	// The query starts from the lowest device watermark
+	mock.ExpectQuery(`ORDER BY smy\.OID`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), sql.Named("StartOID", int64(5))).
+		WillReturnRows(rows)
+
+	if err := e.updateMilkingMetrics(context.Background(), e.db.Load()); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+
+	// OID 8 was already processed for device 2
+	output := currentMetrics(t, e)
+	for device, sessions := range map[string]string{"1": "2", "2": "1"} {
+		if !regexp.MustCompile(`(?m)^delpro_milk_sessions_total\{[^}]*milk_device_id="` + device + `"[^}]*\} ` + sessions + `$`).MatchString(output) {
+			t.Errorf("sessions counter of device %s does not count %s unprocessed sessions:\n%s", device, sessions, output)
+		}
+	}
+	if want := map[string]int64{"1": 11, "2": 12}; !maps.Equal(e.deviceOIDs, want) || e.lastOID != 12 {
+		t.Errorf("watermarks = %v, last OID %d, want %v and 12", e.deviceOIDs, e.lastOID, want)
+	}
+
+	// Device watermarks survive a restart
+	restarted := newTestExporter(t, Config{PerDeviceWatermark: true})
+	restarted.oidFile = e.oidFile
+	restarted.loadLastOID()
+	if !maps.Equal(restarted.deviceOIDs, e.deviceOIDs) || restarted.lastOID != 12 {
+		t.Errorf("loaded watermarks = %v, last OID %d, want %v and 12", restarted.deviceOIDs, restarted.lastOID, e.deviceOIDs)
+	}
+}
+
+func TestCollectOnScrape(t *testing.T) {
+	sessions := regexp.MustCompile(`(?m)^delpro_milk_sessions_total\{animal_number="1",[^}]*\} ([0-9]+)$`)
+	milkingSuccess := `delpro_scrape_success{collector="milking"} 1`
+
+	// Without scrape-time collection, scrapes serve the last background update
+	background := newTestExporter(t, Config{})
+	connectMockDB(t, background)
+	if output := currentMetrics(t, background); sessions.MatchString(output) || strings.Contains(output, milkingSuccess) {
+		t.Errorf("scrape collected metrics without scrape-time collection:\n%s", output)
+	}
+
+	e := newTestExporter(t, Config{CollectOnScrape: true, MinCollectInterval: time.Minute})
+	mock := connectMockDB(t, e)
+	expectSuccessfulUpdate(mock, milkingRows(1))
+	output := currentMetrics(t, e)
+	if m := sessions.FindStringSubmatch(output); m == nil || m[1] != "1" {
+		t.Fatalf("scrape did not collect the new session:\n%s", output)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Scrapes within the cache window do not query the database, where any query would fail
+	output = currentMetrics(t, e)
+	if !strings.Contains(output, milkingSuccess) {
+		t.Errorf("scrape within the cache window queried the database:\n%s", output)
+	}
+
+	// Once the window elapsed, the next scrape collects again
+	e.collectMu.Lock()
+	e.lastCollect = time.Now().Add(-2 * time.Minute)
+	e.collectMu.Unlock()
+	expectSuccessfulUpdate(mock, milkingRows(2))
+	output = currentMetrics(t, e)
+	if m := sessions.FindStringSubmatch(output); m == nil || m[1] != "2" {
+		t.Errorf("scrape after the cache window did not collect the new session:\n%s", output)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOutputTimezone(t *testing.T) {
+	cest := time.FixedZone("CEST", 2*60*60)
+	end := time.Date(2024, 5, 1, 4, 30, 0, 0, time.UTC)
+	record := &models.MilkingRecord{
+		OID: 1, AnimalNumber: "1", AnimalName: "Bella", AnimalRegNo: "CH1", BreedName: "Holstein", DeviceID: "1",
+		DestinationName: "Tank", Yield: 12.5, BeginTime: end.Add(-8 * time.Minute), EndTime: end,
+	}
+
+	tests := []struct {
+		location *time.Location
+		dayStart time.Time
+		hour     string
+	}{
+		{time.UTC, time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), "04"},
+		{cest, time.Date(2024, 4, 30, 22, 0, 0, 0, time.UTC), "06"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.location.String(), func(t *testing.T) {
+			cfg := Config{OutputLocation: tt.location}
+			cfg.Metrics.Location = tt.location
+			e := newTestExporter(t, cfg)
+			now := time.Now()
+
+			// Date-only values are days of the output timezone
+			if got, ok := e.parseTimeParam("2024-05-01", now, false); !ok || !got.Equal(tt.dayStart) {
+				t.Errorf("start of 2024-05-01 = %v, want %v", got, tt.dayStart)
+			}
+			if got, ok := e.parseTimeParam("2024-05-01", now, true); !ok || !got.Equal(tt.dayStart.Add(24*time.Hour-time.Nanosecond)) {
+				t.Errorf("end of 2024-05-01 = %v, want the last instant of the day", got)
+			}
+
+			// Absolute times and exposed epoch values do not depend on the output timezone
+			for _, value := range []string{"2024-05-01T04:30:00Z", "2024-05-01T06:30:00+02:00", "1714537800"} {
+				if got, ok := e.parseTimeParam(value, now, false); !ok || !got.Equal(end) {
+					t.Errorf("parseTimeParam(%q) = %v, want %v", value, got, end)
+				}
+			}
+			e.metrics.CreateMetricsFromRecords([]*models.MilkingRecord{record})
+			output := currentMetrics(t, e)
+			if !regexp.MustCompile(`(?m)^delpro_milk_last_yield_timestamp\{[^}]*\} 1714537800$`).MatchString(output) {
+				t.Errorf("last yield timestamp differs from the session end epoch:\n%s", output)
+			}
+			if !strings.Contains(output, `delpro_sessions_by_hour{hour="`+tt.hour+`"} 1`) {
+				t.Errorf("session not counted at hour %s of the output timezone:\n%s", tt.hour, output)
+			}
+		})
+	}
+}
+
+func TestUpdateDurationObservedPerUpdate(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	mock := connectMockDB(t, e)
+	count := regexp.MustCompile(`(?m)^delpro_exporter_update_duration_seconds_count ([0-9]+)$`)
+
+	// Only the first update succeeds, the following ones fail on unexpected queries and are observed as well
+	expectSuccessfulUpdate(mock, milkingRows(1))
+	for i := 1; i <= 3; i++ {
+		e.UpdateMetrics()
+		output := currentMetrics(t, e)
+		if m := count.FindStringSubmatch(output); m == nil || m[1] != fmt.Sprint(i) {
+			t.Fatalf("update %d: update duration samples %v, want %d:\n%s", i, m, i, output)
+		}
+	}
+}
+
+func TestHistoricalRangeModes(t *testing.T) {
+	start, end := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+	at := func(want time.Time) timeArg { return func(t time.Time) bool { return t.Equal(want) } }
+
+	tests := []struct {
+		rangeMode  string
+		start, end timeArg
+	}{
+		// Records must be within both the time and the OID range
+		{"", at(start), at(end.Add(-time.Nanosecond))},
+		{"intersect", at(start), at(end.Add(-time.Nanosecond))},
+		// The time range is ignored, records only being restricted by OID
+		{"oid", at(oidOnlyStart), func(t time.Time) bool { return t.After(end) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rangeMode, func(t *testing.T) {
+			e := newTestExporter(t, Config{})
+			mock := connectMockDB(t, e)
+			mock.ExpectQuery(`smy\.EndTime >= @StartTime AND smy\.EndTime < @EndTime\s+AND smy\.OID > @StartOID .* AND smy\.OID <= @EndOID`).
+				WithArgs(tt.start, tt.end, sql.Named("StartOID", int64(10)), sql.Named("EndOID", int64(20))).
+				WillReturnRows(milkingRows(11, 12))
+
+			rec := httptest.NewRecorder()
+			e.WriteHistoricalMetrics(httptest.NewRequest("GET", "/historical-metrics?start=2024-05-01&end=2024-05-01&start_oid=10&end_oid=20&range_mode="+tt.rangeMode, nil), rec)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+
+	e := newTestExporter(t, Config{})
+	connectMockDB(t, e)
+	rec := httptest.NewRecorder()
+	e.WriteHistoricalMetrics(httptest.NewRequest("GET", "/historical-metrics?start_oid=10&range_mode=union", nil), rec)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown range mode status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
+
+func TestHeartbeatAdvancesEachPoll(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	mock := connectMockDB(t, e)
+	heartbeat := regexp.MustCompile(`(?m)^delpro_exporter_heartbeat_timestamp ([0-9]+)$`)
+
+	// A poll without new records, then a failing poll
+	expectSuccessfulUpdate(mock, sqlmock.NewRows(milkingColumns))
+	for i := range 2 {
+		e.metrics.SetHeartbeat(time.Unix(0, 0))
+		before := time.Now().Unix()
+		e.UpdateMetrics()
+
+		m := heartbeat.FindStringSubmatch(currentMetrics(t, e))
+		if m == nil {
+			t.Fatalf("poll %d: heartbeat not exposed", i+1)
+		}
+		if value, _ := strconv.ParseInt(m[1], 10, 64); value < before {
+			t.Errorf("poll %d: heartbeat = %d, want at least %d", i+1, value, before)
+		}
+	}
+}
+
+func TestDisableHistoricalGzip(t *testing.T) {
+	for _, disabled := range []bool{false, true} {
+		e := newTestExporter(t, Config{DisableHistoricalGzip: disabled})
+		mock := connectMockDB(t, e)
+		mock.ExpectQuery(`FROM`).WillReturnRows(milkingRows(1))
+
+		req := httptest.NewRequest("GET", "/historical-metrics?start=2024-05-01&end=2024-05-02", nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		e.WriteHistoricalMetrics(req, rec)
+
+		body := io.Reader(rec.Body)
+		if encoding := rec.Header().Get("Content-Encoding"); disabled {
+			if encoding != "" {
+				t.Fatalf("gzip disabled: Content-Encoding = %q, want plain output", encoding)
+			}
+		} else {
+			if encoding != "gzip" {
+				t.Fatalf("Content-Encoding = %q, want gzip", encoding)
+			}
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body = zr
+		}
+		output, err := io.ReadAll(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(output), "delpro_milk_sessions_total{") {
+			t.Errorf("gzip disabled %t: output lacks the session counter:\n%s", disabled, output)
+		}
+	}
+}
+
+func TestConnectsLazilyOnceDatabaseIsUp(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	connected := regexp.MustCompile(`(?m)^delpro_db_connected ([01])$`)
+
+	// The database is unreachable, metrics are still served with the failure reported
+	e.UpdateMetrics()
+	output := currentMetrics(t, e)
+	if m := connected.FindStringSubmatch(output); m == nil || m[1] != "0" {
+		t.Errorf("database connected with an unreachable database:\n%s", output)
+	}
+	if !strings.Contains(output, `delpro_scrape_success{collector="milking"} 0`) {
+		t.Errorf("failed collection not reported:\n%s", output)
+	}
+
+	// The database comes up, the next update connects, running the counter initialization query first
+	mock := useMockDB(t, e)
+	mock.ExpectQuery(`ORDER BY smy\.OID`).WillReturnRows(sqlmock.NewRows(milkingColumns))
+	expectSuccessfulUpdate(mock, milkingRows(1))
+	e.UpdateMetrics()
+	output = currentMetrics(t, e)
+	if m := connected.FindStringSubmatch(output); m == nil || m[1] != "1" {
+		t.Errorf("database not connected once reachable:\n%s", output)
+	}
+	if !strings.Contains(output, `delpro_scrape_success{collector="milking"} 1`) {
+		t.Errorf("successful collection not reported:\n%s", output)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScrapeResultsPerCollector(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	mock := connectMockDB(t, e)
+	// The milking records query fails, the other collectors still run
+	mock.ExpectQuery(`ORDER BY smy\.OID`).WillReturnError(errors.New("deadlock victim"))
+	mock.ExpectQuery(`GROUP BY smy\.MilkingDevice`).
+		WillReturnRows(sqlmock.NewRows([]string{"device", "sessions", "incomplete"}).AddRow("1", int64(10), int64(1)))
+	mock.ExpectQuery(`COUNT_BIG`).WillReturnRows(sqlmock.NewRows([]string{"total"}).AddRow(int64(100)))
+
+	before := time.Now().Unix()
+	e.UpdateMetrics()
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Fatal(err)
+	}
+	output := currentMetrics(t, e)
+
+	for collector, success := range map[string]string{"milking": "0", "utilization": "1", "sessions": "1"} {
+		label := `{collector="` + collector + `"}`
+		if !strings.Contains(output, "delpro_scrape_success"+label+" "+success+"\n") {
+			t.Errorf("scrape success of %s is not %s:\n%s", collector, success, output)
+		}
+		if !strings.Contains(output, "delpro_scrape_duration_seconds"+label+" ") {
+			t.Errorf("scrape duration of %s not exposed", collector)
+		}
+
+		// Only successful collections advance their last success timestamp
+		m := regexp.MustCompile(`(?m)^delpro_last_successful_scrape_timestamp` + regexp.QuoteMeta(label) + ` ([0-9]+)$`).FindStringSubmatch(output)
+		if (m != nil) != (success == "1") {
+			t.Errorf("last successful scrape of %s exposed = %t, want %t", collector, m != nil, success == "1")
+		}
+		if m != nil {
+			if ts, _ := strconv.ParseInt(m[1], 10, 64); ts < before {
+				t.Errorf("last successful scrape of %s = %d, want at least %d", collector, ts, before)
+			}
+		}
+	}
+}
+
+func TestRecoverOIDFromDB(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		e := newTestExporter(t, Config{RecoverOIDFromDB: enabled})
+		// The OID file was lost, or lags behind the database
+		e.lastOID = 7
+		mock := useMockDB(t, e)
+		if enabled {
+			mock.ExpectQuery(`MAX\(OID\)`).WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(int64(1500)))
+		}
+		mock.ExpectQuery(`ORDER BY smy\.OID`).WillReturnRows(sqlmock.NewRows(milkingColumns))
+		if _, err := e.connect(); err != nil {
+			t.Fatal(err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Fatalf("recovery %t: %v", enabled, err)
+		}
+
+		want := int64(7)
+		if enabled {
+			want = 1500
+		}
+		if e.lastOID != want || e.startupOID != want {
+			t.Errorf("recovery %t: last OID %d, startup OID %d, want %d", enabled, e.lastOID, e.startupOID, want)
+		}
+		// The recovered watermark is persisted
+		if data, _ := os.ReadFile(e.oidFile); enabled && strings.TrimSpace(string(data)) != "1500" {
+			t.Errorf("OID file = %q, want 1500", data)
+		}
+	}
+}
+
+func TestSourceLabel(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		// The configuration info metrics have a source label of their own, which is kept
+		settings := []models.ConfigSetting{{Name: "source-label", Value: strconv.FormatBool(enabled), Source: "flag"}}
+		e := newTestExporter(t, Config{SourceLabel: enabled, Settings: settings})
+		mock := connectMockDB(t, e)
+		expectSuccessfulUpdate(mock, milkingRows(1))
+		e.UpdateMetrics()
+		mock.ExpectQuery(`FROM`).WillReturnRows(milkingRows(1))
+
+		rec := httptest.NewRecorder()
+		e.WriteHistoricalMetrics(httptest.NewRequest("GET", "/historical-metrics?start=2024-05-01&end=2024-05-02", nil), rec)
+		for source, output := range map[string]string{sourceLive: currentMetrics(t, e), sourceHistorical: rec.Body.String()} {
+			if output == "" {
+				t.Fatalf("%s output is empty", source)
+			}
+			for line := range strings.Lines(output) {
+				if strings.HasPrefix(line, "#") {
+					continue
+				}
+				if strings.HasPrefix(line, models.MetricExporterConfig+"{") {
+					if strings.Count(line, "source=") != 1 || !strings.Contains(line, `source="flag"`) {
+						t.Errorf("source label %t: %s configuration series %q", enabled, source, line)
+					}
+					continue
+				}
+				labeled := strings.Contains(line, "source=")
+				if labeled != enabled || enabled && !strings.Contains(line, fmt.Sprintf("source=%q", source)) {
+					t.Errorf("source label %t: %s series %q", enabled, source, line)
+				}
+			}
+		}
+	}
+}
+
+func TestLookbackWindows(t *testing.T) {
+	for _, tt := range []struct{ live, historical time.Duration }{
+		{0, 0},
+		{6 * time.Hour, 90 * 24 * time.Hour},
+	} {
+		e := newTestExporter(t, Config{LookbackWindow: tt.live, HistoricalLookback: tt.historical})
+		live, historical := cmp.Or(tt.live, models.DefaultLookbackWindow), cmp.Or(tt.historical, models.HistoricalLookbackHours)
+
+		// Live queries start one lookback window before the delayed end
+		mock := connectMockDB(t, e)
+		before := time.Now().Add(-models.LiveDelay - live)
+		windowStart := timeArg(func(start time.Time) bool {
+			return !start.Before(before) && !start.After(time.Now().Add(-models.LiveDelay-live))
+		})
+		mock.ExpectQuery(`ORDER BY smy\.OID`).WithArgs(windowStart, sqlmock.AnyArg(), sqlmock.AnyArg()).
+			WillReturnRows(sqlmock.NewRows(milkingColumns))
+		if err := e.updateMilkingMetrics(context.Background(), e.db.Load()); err != nil {
+			t.Error(err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("live window %s: %v", live, err)
+		}
+
+		// Historical requests default to the historical lookback, explicit start and end take precedence
+		start, end, err := e.parseTimeRangeWithLocation(httptest.NewRequest("GET", "/historical-metrics", nil))
+		if err != nil || end.Sub(start) != historical {
+			t.Errorf("default historical range = %s (%v), want %s", end.Sub(start), err, historical)
+		}
+		start, end, err = e.parseTimeRangeWithLocation(httptest.NewRequest("GET", "/historical-metrics?start=2024-05-01&end=2024-05-03", nil))
+		wantStart, wantEnd := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 4, 0, 0, 0, 0, time.UTC).Add(-time.Nanosecond)
+		if err != nil || !start.Equal(wantStart) || !end.Equal(wantEnd) {
+			t.Errorf("explicit historical range = [%v, %v] (%v), want [%v, %v]", start, end, err, wantStart, wantEnd)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	if err := e.Ping(context.Background()); !errors.Is(err, errDBUnavailable) {
+		t.Errorf("ping before connecting = %v, want %v", err, errDBUnavailable)
+	}
+
+	connectMockDB(t, e)
+	if err := e.Ping(context.Background()); err != nil {
+		t.Errorf("ping once connected = %v", err)
+	}
+
+	// The database going away after connecting makes the exporter unready again
+	e.db.Load().Close()
+	if err := e.Ping(context.Background()); err == nil {
+		t.Error("ping succeeded on a closed database")
+	}
+}
+
+func TestHistoricalRetries(t *testing.T) {
+	for _, tt := range []struct {
+		retries int
+		status  int
+	}{
+		{0, http.StatusInternalServerError},
+		{1, http.StatusOK},
+	} {
+		e := newTestExporter(t, Config{HistoricalRetries: tt.retries, HistoricalRetryBackoff: time.Millisecond})
+		mock := connectMockDB(t, e)
+		mock.ExpectQuery(`FROM`).WillReturnError(errors.New("connection reset"))
+		mock.ExpectQuery(`FROM`).WillReturnRows(milkingRows(1))
+
+		rec := httptest.NewRecorder()
+		e.WriteHistoricalMetrics(httptest.NewRequest("GET", "/historical-metrics?start=2024-05-01&end=2024-05-02", nil), rec)
+		if rec.Code != tt.status {
+			t.Errorf("%d retries: status = %d, want %d", tt.retries, rec.Code, tt.status)
+		}
+		if sessions := strings.Contains(rec.Body.String(), "delpro_milk_sessions_total{"); sessions != (tt.status == http.StatusOK) {
+			t.Errorf("%d retries: output holds sessions %t:\n%s", tt.retries, sessions, rec.Body.String())
+		}
+	}
+}
+
+func TestMetadataEmitted(t *testing.T) {
+	e := newTestExporter(t, Config{})
+	mock := connectMockDB(t, e)
+	expectSuccessfulUpdate(mock, milkingRows(1, 2))
+	e.UpdateMetrics()
+	mock.ExpectQuery(`FROM`).WillReturnRows(milkingRows(1, 2))
+
+	rec := httptest.NewRecorder()
+	e.WriteHistoricalMetrics(httptest.NewRequest("GET", "/historical-metrics?start=2024-05-01&end=2024-05-02", nil), rec)
+
+	descriptors := make(map[string]models.MetricDescriptor)
+	for _, d := range models.MetricDescriptors {
+		descriptors[d.Name] = d
+	}
+	for endpoint, output := range map[string]string{"live": currentMetrics(t, e), "historical": rec.Body.String()} {
+		help, types := make(map[string]string), make(map[string]models.MetricType)
+		for line := range strings.Lines(output) {
+			line = strings.TrimSuffix(line, "\n")
+			if comment, found := strings.CutPrefix(line, "# HELP "); found {
+				family, text, _ := strings.Cut(comment, " ")
+				if _, annotated := help[family]; annotated {
+					t.Errorf("%s: %s annotated twice", endpoint, family)
+				}
+				help[family] = text
+				continue
+			}
+			if comment, found := strings.CutPrefix(line, "# TYPE "); found {
+				family, metricType, _ := strings.Cut(comment, " ")
+				types[family] = models.MetricType(metricType)
+				continue
+			}
+
+			name, _, _ := strings.Cut(line, " ")
+			name, _, _ = strings.Cut(name, "{")
+			if !strings.HasPrefix(name, "delpro_") {
+				continue
+			}
+			family := name
+			if _, found := descriptors[family]; !found {
+				for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+					family = strings.TrimSuffix(family, suffix)
+				}
+			}
+			d, found := descriptors[family]
+			if !found {
+				t.Errorf("%s: %s has no descriptor", endpoint, name)
+				continue
+			}
+			if help[family] != d.Help || types[family] != d.Type {
+				t.Errorf("%s: %s sample before its metadata, help %q and type %q", endpoint, name, help[family], types[family])
+			}
+		}
+		if _, found := types[models.MetricMilkSessions]; !found {
+			t.Errorf("%s: no metadata for %s:\n%s", endpoint, models.MetricMilkSessions, output)
+		}
+	}
+}
+
+func TestWeightCollection(t *testing.T) {
+	weighed := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name    string
+		collect bool
+		table   bool
+		want    bool
+	}{
+		{"disabled", false, true, false},
+		{"enabled", true, true, true},
+		{"enabled without scales", true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExporter(t, Config{CollectWeight: tt.collect})
+			mock := connectMockDB(t, e)
+			for range 2 {
+				expectSuccessfulUpdate(mock, milkingRows(1))
+			}
+			if tt.collect {
+				// Without weighing table, collection is turned off after the first update
+				mock.ExpectQuery(`OBJECT_ID`).WithArgs(sql.Named("Table", "AnimalWeight")).
+					WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(tt.table))
+				if tt.table {
+					mock.ExpectQuery(`OBJECT_ID`).WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+					for range 2 {
+						mock.ExpectQuery(`FROM AnimalWeight`).WillReturnRows(
+							sqlmock.NewRows([]string{"animal_number", "animal_name", "animal_reg_no", "weight", "time"}).
+								AddRow("1", "Bella", "CH1", 642.0, weighed))
+					}
+				}
+			}
+			e.UpdateMetrics()
+			e.UpdateMetrics()
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Error(err)
+			}
+
+			output := currentMetrics(t, e)
+			weight := regexp.MustCompile(`(?m)^delpro_animal_weight_kg\{[^}]*animal_number="1"[^}]*\} 642$`)
+			if weight.MatchString(output) != tt.want {
+				t.Errorf("weight emitted = %t, want %t:\n%s", !tt.want, tt.want, output)
+			}
+			if !e.Ready() {
+				t.Error("exporter not ready, weight collection failed the update")
+			}
+		})
+	}
+}
+
+func TestFutureTimeRange(t *testing.T) {
+	now := time.Now()
+	unix := func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) }
+	tests := []struct {
+		name   string
+		query  string
+		status int
+	}{
+		{"past range", "?start=2024-05-01&end=2024-05-02", http.StatusOK},
+		{"start within clock skew", "?start=" + unix(now.Add(time.Minute)) + "&end=now%2B10m", http.StatusOK},
+		{"end in the future", "?start=now-1h&end=now%2B1h", http.StatusOK},
+		{"start in the future", "?start=" + unix(now.Add(time.Hour)), http.StatusBadRequest},
+		{"start next year", "?start=" + now.AddDate(1, 0, 0).Format("2006-01-02") + "&end=" + now.AddDate(1, 0, 1).Format("2006-01-02"), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := newTestExporter(t, Config{})
+			mock := connectMockDB(t, e)
+			mock.ExpectQuery(`FROM`).WillReturnRows(milkingRows(1))
+
+			rec := httptest.NewRecorder()
+			e.WriteHistoricalMetrics(httptest.NewRequest("GET", "/historical-metrics"+tt.query, nil), rec)
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+			if tt.status == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "in the future") {
+				t.Errorf("error %q does not explain the start is in the future", rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// Backend selects the library serving the /metrics endpoint
+type Backend string
+
+const (
+	BackendVictoriaMetrics Backend = "victoriametrics" // VictoriaMetrics sets written as is
+	BackendPrometheus      Backend = "prometheus"      // Prometheus registry gathering a Collector
+)
+
+// ParseBackend parses a metrics backend name
+func ParseBackend(backend string) (Backend, error) {
+	switch b := Backend(backend); b {
+	case BackendVictoriaMetrics, BackendPrometheus:
+		return b, nil
+	default:
+		return "", fmt.Errorf("invalid metrics backend %q, use victoriametrics or prometheus", backend)
+	}
+}
+
+// collectErrorDesc describes the invalid metric reported when the metrics cannot be collected
+var collectErrorDesc = prometheus.NewDesc("delpro_exporter_collect_error", "Error collecting DelPro metrics", nil, nil)
+
+// Collector implements prometheus.Collector, building constant metrics on each scrape from the
+// Prometheus text output of a writer, so that both backends expose the same series
+// Histograms must use the Prometheus format, as vmrange buckets have no Prometheus equivalent
+type Collector struct {
+	write func(w io.Writer) error
+}
+
+// NewCollector creates a new collector of the metrics written by write, which must include type metadata
+func NewCollector(write func(w io.Writer) error) *Collector {
+	return &Collector{write: write}
+}
+
+// Describe sends no descriptors, the collector is unchecked as its series depend on the processed records
+func (c *Collector) Describe(chan<- *prometheus.Desc) {}
+
+// Collect writes the current metrics and sends them as constant metrics
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	var buf bytes.Buffer
+	if err := c.write(&buf); err != nil {
+		ch <- prometheus.NewInvalidMetric(collectErrorDesc, err)
+		return
+	}
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(&buf)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(collectErrorDesc, err)
+		return
+	}
+
+	for name, family := range families {
+		for _, m := range family.GetMetric() {
+			metric, err := constMetric(name, family, m)
+			if err != nil {
+				metric = prometheus.NewInvalidMetric(collectErrorDesc, err)
+			}
+			ch <- metric
+		}
+	}
+}
+
+// constMetric converts a parsed sample to a constant metric of its family type, families without type being untyped
+func constMetric(name string, family *dto.MetricFamily, m *dto.Metric) (prometheus.Metric, error) {
+	labelNames := make([]string, 0, len(m.GetLabel()))
+	labelValues := make([]string, 0, len(m.GetLabel()))
+	for _, label := range m.GetLabel() {
+		labelNames = append(labelNames, label.GetName())
+		labelValues = append(labelValues, label.GetValue())
+	}
+	desc := prometheus.NewDesc(name, family.GetHelp(), labelNames, nil)
+
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		return prometheus.NewConstMetric(desc, prometheus.CounterValue, m.GetCounter().GetValue(), labelValues...)
+	case dto.MetricType_GAUGE:
+		return prometheus.NewConstMetric(desc, prometheus.GaugeValue, m.GetGauge().GetValue(), labelValues...)
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		// The +Inf bucket is implied by the sample count
+		buckets := make(map[float64]uint64, len(h.GetBucket()))
+		for _, b := range h.GetBucket() {
+			if !math.IsInf(b.GetUpperBound(), 1) {
+				buckets[b.GetUpperBound()] = b.GetCumulativeCount()
+			}
+		}
+		return prometheus.NewConstHistogram(desc, h.GetSampleCount(), h.GetSampleSum(), buckets, labelValues...)
+	default:
+		return prometheus.NewConstMetric(desc, prometheus.UntypedValue, m.GetUntyped().GetValue(), labelValues...)
+	}
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// InfluxWriter wraps an io.Writer and converts timestamped Prometheus exposition lines to InfluxDB line protocol
+type InfluxWriter struct {
+	lineWriter
+
+	writer io.Writer
+}
+
+// NewInfluxWriter creates a new InfluxDB line protocol writer
+func NewInfluxWriter(w io.Writer) *InfluxWriter {
+	iw := &InfluxWriter{writer: w}
+	iw.transform = iw.writeLine
+	return iw
+}
+
+// writeLine converts a single `name{labels} value timestamp_ms` line to `name,tags value=v timestamp_ns`
+func (iw *InfluxWriter) writeLine(line string) error {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil
+	}
+
+	name, labels, rest := line, "", ""
+	if i := strings.Index(line, "{"); i != -1 {
+		j := strings.LastIndex(line, "}")
+		if j < i {
+			return fmt.Errorf("invalid metric line: %q", line)
+		}
+		name, labels, rest = line[:i], line[i+1:j], line[j+1:]
+	} else if i := strings.Index(line, " "); i != -1 {
+		name, rest = line[:i], line[i:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) != 2 {
+		return fmt.Errorf("invalid metric line, value and timestamp expected: %q", line)
+	}
+	timestampMs, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid metric timestamp: %q", line)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(influxEscape(name, false))
+	for _, label := range parseLabels(labels) {
+		sb.WriteString(",")
+		sb.WriteString(influxEscape(label[0], true))
+		sb.WriteString("=")
+		sb.WriteString(influxEscape(label[1], true))
+	}
+
+	_, err = fmt.Fprintf(iw.writer, "%s value=%s %d\n", sb.String(), fields[0], timestampMs*1e6)
+	return err
+}
+
+// parseLabels parses a Prometheus label list (`k1="v1",k2="v2"`) into key/value pairs
+func parseLabels(labels string) [][2]string {
+	var pairs [][2]string
+
+	for labels != "" {
+		eq := strings.Index(labels, "=")
+		if eq == -1 || eq+1 >= len(labels) || labels[eq+1] != '"' {
+			break
+		}
+		key := strings.TrimSpace(labels[:eq])
+
+		// Find the closing quote, skipping escaped characters
+		var value strings.Builder
+		i := eq + 2
+		for ; i < len(labels) && labels[i] != '"'; i++ {
+			if labels[i] == '\\' && i+1 < len(labels) {
+				i++
+			}
+			value.WriteByte(labels[i])
+		}
+		pairs = append(pairs, [2]string{key, value.String()})
+
+		labels = strings.TrimPrefix(labels[min(i+1, len(labels)):], ",")
+	}
+
+	return pairs
+}
+
+// influxEscape escapes special characters of measurement names, tag keys and tag values
+func influxEscape(s string, tag bool) string {
+	replacer := strings.NewReplacer(",", `\,`, " ", `\ `)
+	if tag {
+		replacer = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+	}
+	return replacer.Replace(s)
+}
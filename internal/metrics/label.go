@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// LabelWriter wraps an io.Writer and adds a constant label to each Prometheus exposition line
+type LabelWriter struct {
+	lineWriter
+
+	writer io.Writer
+	label  string
+	name   string // Name of the added label
+}
+
+// NewLabelWriter creates a new writer adding the given `name="value"` label to every series
+// Series already carrying a label of the same name keep their own value
+func NewLabelWriter(w io.Writer, label string) *LabelWriter {
+	name, _, _ := strings.Cut(label, "=")
+	lw := &LabelWriter{
+		writer: w,
+		label:  label,
+		name:   name,
+	}
+	lw.transform = lw.writeLine
+	return lw
+}
+
+// writeLine adds the label to a `name{labels} value [timestamp]` line, comment lines are forwarded as is
+func (lw *LabelWriter) writeLine(line string) error {
+	if strings.HasPrefix(line, "#") {
+		_, err := fmt.Fprintf(lw.writer, "%s\n", line)
+		return err
+	}
+
+	// Labels are closed by the last brace, as quoted values may contain spaces
+	if i := strings.Index(line, "{"); i != -1 {
+		j := strings.LastIndex(line, "}")
+		if j < i {
+			return fmt.Errorf("invalid metric line: %q", line)
+		}
+		if labels := line[i+1 : j]; strings.HasPrefix(labels, lw.name+"=") || strings.Contains(labels, ","+lw.name+"=") {
+			_, err := fmt.Fprintf(lw.writer, "%s\n", line)
+			return err
+		}
+		separator := ","
+		if j == i+1 {
+			separator = ""
+		}
+		_, err := fmt.Fprintf(lw.writer, "%s%s%s%s\n", line[:j], separator, lw.label, line[j:])
+		return err
+	}
+
+	name, rest, _ := strings.Cut(line, " ")
+	_, err := fmt.Fprintf(lw.writer, "%s{%s} %s\n", name, lw.label, rest)
+	return err
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+)
+
+// lineWriter buffers writes and passes each complete, non-blank line to a per-line transform
+// It is embedded by the writers converting the exposition format, which only implement their transform
+// A final line without trailing newline is buffered until Flush, which callers must call once done writing
+// The first transform error is kept and returned by Flush, as callers such as metrics.Set.WritePrometheus ignore write errors
+type lineWriter struct {
+	transform func(line string) error
+	buffer    bytes.Buffer
+	err       error
+}
+
+// Write buffers data and transforms each complete line
+func (lw *lineWriter) Write(p []byte) (n int, err error) {
+	if lw.err != nil {
+		return 0, lw.err
+	}
+	lw.buffer.Write(p)
+
+	// Process complete lines only, keeping the trailing incomplete line in buffer
+	data := lw.buffer.String()
+	lastNewline := strings.LastIndex(data, "\n")
+	if lastNewline == -1 {
+		return len(p), nil
+	}
+	lw.buffer.Reset()
+	lw.buffer.WriteString(data[lastNewline+1:])
+
+	for _, line := range strings.Split(data[:lastNewline], "\n") {
+		if err := lw.handleLine(line); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush transforms any remaining buffered data, returning the first error of all writes
+func (lw *lineWriter) Flush() error {
+	if lw.err == nil && lw.buffer.Len() > 0 {
+		line := lw.buffer.String()
+		lw.buffer.Reset()
+		lw.handleLine(line)
+	}
+	return lw.err
+}
+
+// handleLine transforms a line, skipping blank ones, and keeps the transform error
+func (lw *lineWriter) handleLine(line string) error {
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+	lw.err = lw.transform(line)
+	return lw.err
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/clementnuss/delpro-exporter/internal/models"
+)
+
+// MetadataWriter wraps an io.Writer and emits # HELP and # TYPE lines before the first sample of each known metric family
+type MetadataWriter struct {
+	lineWriter
+
+	writer      io.Writer
+	descriptors map[string]models.MetricDescriptor
+	written     map[string]bool
+	teatPrefix  string
+}
+
+// NewMetadataWriter creates a new writer annotating the metric families of models.MetricDescriptors, teat families
+// being named with the teat metric prefix of naming
+func NewMetadataWriter(w io.Writer, naming models.Naming) *MetadataWriter {
+	descriptors := make(map[string]models.MetricDescriptor, len(models.MetricDescriptors))
+	for _, d := range models.MetricDescriptors {
+		descriptors[d.Name] = d
+	}
+
+	mw := &MetadataWriter{
+		writer:      w,
+		descriptors: descriptors,
+		written:     make(map[string]bool),
+		teatPrefix:  naming.TeatPrefix(),
+	}
+	mw.transform = mw.writeLine
+	return mw
+}
+
+// writeLine forwards a line, preceded by the metadata of its family when it is the first sample of a known family
+// Families are only annotated once, even when their samples are not contiguous as in historical output
+func (mw *MetadataWriter) writeLine(line string) error {
+	if !strings.HasPrefix(line, "#") {
+		if family, d, found := mw.descriptor(lineMetricName(line)); found && !mw.written[family] {
+			mw.written[family] = true
+			if _, err := fmt.Fprintf(mw.writer, "# HELP %s %s\n# TYPE %s %s\n", family, d.Help, family, d.Type); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err := fmt.Fprintf(mw.writer, "%s\n", line)
+	return err
+}
+
+// descriptor returns the family and descriptor of a sample metric name, resolving histogram series and teat metric prefixes
+func (mw *MetadataWriter) descriptor(name string) (string, models.MetricDescriptor, bool) {
+	family := name
+	d, found := mw.lookup(name)
+	if !found {
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			if base, cut := strings.CutSuffix(name, suffix); cut {
+				if d, found = mw.lookup(base); found && d.Type == models.MetricTypeHistogram {
+					family = base
+					break
+				}
+				found = false
+			}
+		}
+	}
+	return family, d, found
+}
+
+// lookup returns the descriptor of a family name, teat families being registered under the default prefix
+func (mw *MetadataWriter) lookup(family string) (models.MetricDescriptor, bool) {
+	if d, found := mw.descriptors[family]; found {
+		return d, true
+	}
+	if rest, cut := strings.CutPrefix(family, mw.teatPrefix); cut {
+		d, found := mw.descriptors[models.MetricPrefix+rest]
+		return d, found
+	}
+	return models.MetricDescriptor{}, false
+}
@@ -1,10 +1,16 @@
 package metrics
 
 import (
-	"bytes"
+	"cmp"
+	"database/sql"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"math"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -12,162 +18,797 @@ import (
 	"github.com/clementnuss/delpro-exporter/internal/models"
 )
 
+// TeatMetricStyle selects which teat metrics are emitted
+type TeatMetricStyle string
+
+const (
+	TeatStylePerTeat  TeatMetricStyle = "teat"  // One series per affected teat
+	TeatStyleCombined TeatMetricStyle = "teats" // One series per combination of affected teats
+	TeatStyleBoth     TeatMetricStyle = "both"  // Both per teat and combined series
+)
+
+// ParseTeatMetricStyle parses a teat metric style name
+func ParseTeatMetricStyle(style string) (TeatMetricStyle, error) {
+	switch s := TeatMetricStyle(style); s {
+	case TeatStylePerTeat, TeatStyleCombined, TeatStyleBoth:
+		return s, nil
+	default:
+		return "", fmt.Errorf("invalid teat metric style %q, use teat, teats or both", style)
+	}
+}
+
+// HistogramFormat selects the bucket representation of histograms
+type HistogramFormat string
+
+const (
+	// HistogramVMRange uses VictoriaMetrics log-scale `vmrange` buckets, its equivalent of native histograms
+	HistogramVMRange HistogramFormat = "vmrange"
+	// HistogramPrometheus uses classic Prometheus `le` buckets, which Prometheus can convert to native histograms
+	HistogramPrometheus HistogramFormat = "prometheus"
+)
+
+// ParseHistogramFormat parses a histogram format name
+func ParseHistogramFormat(format string) (HistogramFormat, error) {
+	switch f := HistogramFormat(format); f {
+	case HistogramVMRange, HistogramPrometheus:
+		return f, nil
+	default:
+		return "", fmt.Errorf("invalid histogram format %q, use vmrange or prometheus", format)
+	}
+}
+
+// MissingLactation selects how days in lactation are exposed for animals without an open lactation
+type MissingLactation string
+
+const (
+	MissingLactationOmit     MissingLactation = "omit"     // No days in lactation series
+	MissingLactationSentinel MissingLactation = "sentinel" // Days in lactation set to -1
+	MissingLactationLabel    MissingLactation = "label"    // has_lactation label on days in lactation, 0 without lactation
+)
+
+// ParseMissingLactation parses a missing lactation behavior name
+func ParseMissingLactation(behavior string) (MissingLactation, error) {
+	switch m := MissingLactation(behavior); m {
+	case MissingLactationOmit, MissingLactationSentinel, MissingLactationLabel:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid missing lactation behavior %q, use omit, sentinel or label", behavior)
+	}
+}
+
+// durationBuckets are the upper bounds of milking duration buckets in the Prometheus histogram format
+var durationBuckets = []float64{120, 240, 360, 480, 600, 720, 900, 1200, 1800}
+
+// updateDurationBuckets are the upper bounds of metrics update duration buckets in the Prometheus histogram format
+var updateDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// sccBuckets are the upper bounds of somatic cell count buckets, matching the usual milk quality thresholds
+var sccBuckets = []float64{100_000, 200_000, 400_000, 1_000_000}
+
+// Config holds the metrics exporter settings
+type Config struct {
+	Location          *time.Location  // Timezone used for hour of day bucketing
+	TeatMetricStyle   TeatMetricStyle // Teat metrics to emit, both when empty
+	DurationHistogram HistogramFormat // Bucket representation of duration histograms, vmrange when empty
+
+	ZeroYieldMinDuration time.Duration    // Duration from which a session without milk is counted as a failed milking
+	MissingLactation     MissingLactation // Days in lactation of animals without an open lactation, omitted when empty
+	AnimalNumberMetric   bool             // Expose animal numbers as values of the animal number metric
+
+	VersionLabel     bool   // Add the data_format_version label to every metric, otherwise only exposed by the info metric
+	BreedIDLabel     bool   // Add the raw breed identifier as breed_id label to animal metrics
+	TeatMetricPrefix string // Replaces the delpro_ prefix on teat metric names, unchanged when empty
+}
+
 // Exporter handles metrics creation and exposition
-type Exporter struct{}
+type Exporter struct {
+	set         *metrics.Set          // Metric set holding live metrics
+	location    *time.Location        // Timezone used for hour of day bucketing
+	teatStyle   TeatMetricStyle       // Teat metrics to emit
+	histogram   HistogramFormat       // Bucket representation of duration histograms
+	lactation   MissingLactation      // Days in lactation of animals without an open lactation
+	yieldRanges map[string]yieldRange // Running min/max yield per animal, keyed by labels
+
+	daysInLactation map[string]int         // Latest days in lactation per animal number
+	lastSessions    map[string]string      // Last session metric name per animal, keyed by labels
+	deviceYields    map[string]deviceYield // Running yield totals per device
+	driedOff        map[string]bool        // Registered dried-off metric names, to drop animals whose lactation closed
+	weights         map[string]bool        // Registered weight metric names, to drop animals no longer weighed
+
+	zeroYieldMinDuration time.Duration // Duration from which a session without milk is counted as a failed milking
+	animalNumberMetric   bool          // Expose animal numbers as values of the animal number metric
+
+	naming models.Naming // Label and name options of exposed metrics
+}
+
+// yieldRange holds the lowest and highest yield observed for an animal
+type yieldRange struct {
+	min, max float64
+	peakAt   time.Time // End of the session with the highest yield
+}
+
+// deviceYield holds the total yield and session count of a milking device
+type deviceYield struct {
+	total    float64
+	sessions int
+}
 
 // TimestampWriter wraps an io.Writer and adds timestamps to each metric line
+// Whole-number values are written as plain integers, such as timestamps that VictoriaMetrics formats as 1.715e+09
+// A final line without trailing newline is buffered until Flush, which callers must call once done writing
 type TimestampWriter struct {
+	lineWriter
+
 	writer    io.Writer
 	timestamp time.Time
-	buffer    bytes.Buffer
 }
 
 // NewTimestampWriter creates a new timestamp writer
 func NewTimestampWriter(w io.Writer, t time.Time) *TimestampWriter {
-	return &TimestampWriter{
+	tw := &TimestampWriter{
 		writer:    w,
 		timestamp: t,
 	}
+	tw.transform = tw.writeLine
+	return tw
 }
 
-// Write intercepts writes and adds timestamps to each metric line
-func (tw *TimestampWriter) Write(p []byte) (n int, err error) {
-	// Accumulate data in buffer
-	tw.buffer.Write(p)
+// writeLine writes a `name{labels} value` line with its value formatted and the timestamp appended
+func (tw *TimestampWriter) writeLine(line string) error {
+	// Labels are closed by the last brace, as quoted values may contain spaces
+	series, value := line, ""
+	if j := strings.LastIndex(line, "}"); j != -1 {
+		series, value = line[:j+1], strings.TrimSpace(line[j+1:])
+	} else if i := strings.Index(line, " "); i != -1 {
+		series, value = line[:i], strings.TrimSpace(line[i:])
+	}
+	if value == "" {
+		_, err := fmt.Fprintf(tw.writer, "%s %d\n", line, tw.timestamp.UnixMilli())
+		return err
+	}
 
-	// Process complete lines
-	data := tw.buffer.String()
-	lines := strings.Split(data, "\n")
+	_, err := fmt.Fprintf(tw.writer, "%s %s %d\n", series, formatValue(value), tw.timestamp.UnixMilli())
+	return err
+}
 
-	// Keep the last (potentially incomplete) line in buffer
-	if len(lines) > 0 && lines[len(lines)-1] != "" {
-		tw.buffer.Reset()
-		tw.buffer.WriteString(lines[len(lines)-1])
-		lines = lines[:len(lines)-1]
-	} else {
-		tw.buffer.Reset()
+// formatValue formats whole-number values as integers, other values are returned unchanged
+func formatValue(value string) string {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsInf(v, 0) || math.IsNaN(v) || v != math.Trunc(v) || math.Abs(v) >= 1<<63 {
+		return value
 	}
+	return strconv.FormatInt(int64(v), 10)
+}
 
-	// Write complete lines with timestamps
-	timestampMs := tw.timestamp.UnixMilli()
-	for _, line := range lines {
-		if strings.TrimSpace(line) != "" {
-			_, err = fmt.Fprintf(tw.writer, "%s %d\n", line, timestampMs)
-			if err != nil {
-				return 0, err
-			}
-		}
+// FilterWriter wraps an io.Writer and only forwards lines of the selected metric families
+type FilterWriter struct {
+	lineWriter
+
+	writer io.Writer
+	names  map[string]bool
+}
+
+// NewFilterWriter creates a new filter writer forwarding only the given metric families
+func NewFilterWriter(w io.Writer, names map[string]bool) *FilterWriter {
+	fw := &FilterWriter{
+		writer: w,
+		names:  names,
 	}
+	fw.transform = fw.writeLine
+	return fw
+}
 
-	return len(p), nil
+// writeLine forwards a single line if it belongs to a selected metric family
+func (fw *FilterWriter) writeLine(line string) error {
+	if !fw.selected(lineMetricName(line)) {
+		return nil
+	}
+	_, err := fmt.Fprintf(fw.writer, "%s\n", line)
+	return err
 }
 
-// Flush writes any remaining buffered data
-func (tw *TimestampWriter) Flush() error {
-	if tw.buffer.Len() > 0 {
-		line := strings.TrimSpace(tw.buffer.String())
-		if line != "" {
-			timestampMs := tw.timestamp.UnixMilli()
-			_, err := fmt.Fprintf(tw.writer, "%s %d\n", line, timestampMs)
-			if err != nil {
-				return err
-			}
+// selected reports whether a metric name belongs to a selected family, including histogram series
+func (fw *FilterWriter) selected(name string) bool {
+	if fw.names[name] {
+		return true
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if base, found := strings.CutSuffix(name, suffix); found && fw.names[base] {
+			return true
 		}
-		tw.buffer.Reset()
 	}
-	return nil
+	return false
 }
 
-// NewExporter creates a new metrics exporter instance
-func NewExporter() *Exporter {
-	return &Exporter{}
+// lineMetricName returns the metric name of an exposition line
+func lineMetricName(line string) string {
+	line = strings.TrimSpace(line)
+
+	// Comment lines are of the form "# HELP name ..." or "# TYPE name ..."
+	if strings.HasPrefix(line, "#") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return ""
+		}
+		return fields[2]
+	}
+
+	if i := strings.IndexAny(line, "{ "); i != -1 {
+		return line[:i]
+	}
+	return line
+}
+
+// NewExporter creates a new metrics exporter instance storing live metrics in set
+// A nil set uses the global default set
+func NewExporter(set *metrics.Set, cfg Config) *Exporter {
+	if set == nil {
+		set = metrics.GetDefaultSet()
+	}
+
+	naming := models.Naming{
+		VersionLabel:     cfg.VersionLabel,
+		BreedIDLabel:     cfg.BreedIDLabel,
+		TeatMetricPrefix: cfg.TeatMetricPrefix,
+	}
+
+	// The info metric always carries the data format version, even when the label is disabled on other metrics
+	set.GetOrCreateGauge(fmt.Sprintf("%s{data_format_version=%q}", models.MetricExporterInfo, models.DataFormatVersion), nil).Set(1)
+	set.GetOrCreateGauge(naming.LabeledMetricName(models.MetricExporterStart, ""), nil).Set(float64(time.Now().Unix()))
+
+	return &Exporter{
+		set:         set,
+		location:    cfg.Location,
+		teatStyle:   cmp.Or(cfg.TeatMetricStyle, TeatStyleBoth),
+		histogram:   cmp.Or(cfg.DurationHistogram, HistogramVMRange),
+		lactation:   cmp.Or(cfg.MissingLactation, MissingLactationOmit),
+		yieldRanges: make(map[string]yieldRange),
+
+		daysInLactation: make(map[string]int),
+		lastSessions:    make(map[string]string),
+		deviceYields:    make(map[string]deviceYield),
+		driedOff:        make(map[string]bool),
+		weights:         make(map[string]bool),
+
+		zeroYieldMinDuration: cfg.ZeroYieldMinDuration,
+		animalNumberMetric:   cfg.AnimalNumberMetric,
+
+		naming: naming,
+	}
+}
+
+// Set returns the metric set holding live metrics
+func (e *Exporter) Set() *metrics.Set {
+	return e.set
+}
+
+// Naming returns the label and name options of exposed metrics
+func (e *Exporter) Naming() models.Naming {
+	return e.naming
 }
 
 // InitializeCountersToZero initializes all gauge metrics to 0 for a given animal record
 func (e *Exporter) InitializeCountersToZero(r *models.MilkingRecord) {
 	// Initialize main gauge metrics to 0
-	metrics.GetOrCreateCounter(r.MetricName(models.MetricMilkSessions)).Set(0)
-	metrics.GetOrCreateGauge(r.MetricName(models.MetricMilkYieldTotal), nil).Set(0)
-	metrics.GetOrCreateGauge(r.MetricName(models.MetricSomaticCellTotal), nil).Set(0)
-	// metrics.GetOrCreateHistogram(r.MetricName(models.MetricMilkingDuration)) // not useful as histograms are not printed when empty // TODO: implement solution
+	e.set.GetOrCreateCounter(e.naming.RecordMetricName(r, models.MetricMilkSessions)).Set(0)
+	e.set.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricMilkYieldTotal), nil).Set(0)
+	e.set.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricSomaticCellTotal), nil).Set(0)
+	e.set.GetOrCreateCounter(e.naming.RecordMetricName(r, models.MetricConductivitySamples)).Set(0)
+	e.set.GetOrCreateCounter(e.naming.RecordMetricName(r, models.MetricZeroYieldLong)).Set(0)
+	e.set.GetOrCreateCounter(e.naming.RecordMetricName(r, models.MetricTotalMilkingTime)).Set(0)
+	// Device counters are shared by animals, so they are only created, never reset
+	// Databases without manual attach column leave it NULL, the counter is then not exposed
+	if r.ManualAttach != nil {
+		e.set.GetOrCreateCounter(e.manualInterventionName(r.DeviceID))
+	}
+	// metrics.GetOrCreateHistogram(e.naming.RecordMetricName(r, models.MetricMilkingDuration)) // not useful as histograms are not printed when empty // TODO: implement solution
 }
 
-// CreateMetricsFromRecords creates VictoriaMetrics from milking records
-func (e *Exporter) CreateMetricsFromRecords(s *metrics.Set, w io.Writer, records []*models.MilkingRecord) {
-	if s == nil {
-		s = metrics.GetDefaultSet()
+// CreateMetricsFromRecords updates the live metrics from milking records
+func (e *Exporter) CreateMetricsFromRecords(records []*models.MilkingRecord) {
+	for _, r := range records {
+		log.Printf("new record processed: %v", r)
+		e.updateRecordMetrics(e.set, r)
+
+		// Herd-wide metrics, only maintained live as historical sets are per animal
+		e.set.GetOrCreateCounter(e.hourMetricName(r.EndTime)).Inc()
+		if r.SomaticCellCount != nil {
+			e.set.GetOrCreatePrometheusHistogramExt(e.naming.LabeledMetricName(models.MetricSCCHistogram, ""), sccBuckets).Update(float64(*r.SomaticCellCount))
+		}
+		e.updateNullFieldMetrics(r)
+		for _, label := range r.CleanedLabels {
+			e.set.GetOrCreateCounter(e.naming.LabeledMetricName(models.MetricLabelCleaned, fmt.Sprintf("label=%q", label))).Inc()
+		}
+		if r.ManualIntervention() {
+			e.set.GetOrCreateCounter(e.manualInterventionName(r.DeviceID)).Inc()
+		}
+
+		e.updateYieldRange(r)
+		e.updateLastSession(r)
+		e.updateDeviceYield(r)
+
+		if r.DaysInLactation != nil {
+			e.daysInLactation[r.AnimalNumber] = *r.DaysInLactation
+		}
 	}
 
+	e.updateHerdDaysInLactation()
+	e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricSessionsProcessed, ""), nil).Add(float64(len(records)))
+}
+
+// CatchUpRecords adds milking records older than those of the live metrics to the counters and histograms
+// Gauges describing the latest sessions and the processing statistics are left untouched
+func (e *Exporter) CatchUpRecords(records []*models.MilkingRecord) {
 	for _, r := range records {
-		if w == nil {
-			log.Printf("new record processed: %v", r)
+		e.updateRecordCounters(e.set, r)
+
+		e.set.GetOrCreateCounter(e.hourMetricName(r.EndTime)).Inc()
+		if r.SomaticCellCount != nil {
+			e.set.GetOrCreatePrometheusHistogramExt(e.naming.LabeledMetricName(models.MetricSCCHistogram, ""), sccBuckets).Update(float64(*r.SomaticCellCount))
+		}
+		if r.ManualIntervention() {
+			e.set.GetOrCreateCounter(e.manualInterventionName(r.DeviceID)).Inc()
 		}
-		s.GetOrCreateCounter(r.MetricName(models.MetricMilkSessions)).Inc()
+	}
+}
 
-		// Last milk yield with timestamp
-		s.GetOrCreateGauge(r.MetricName(models.MetricLastMilkYield), nil).Set(r.Yield)
-		s.GetOrCreateGauge(r.MetricName(models.MetricLastYieldTimestamp), nil).Set(float64(r.EndTime.Unix()))
-		s.GetOrCreateGauge(r.MetricName(models.MetricMilkYieldTotal), nil).Add(r.Yield)
+// updateNullFieldMetrics counts the optional fields missing from a record, revealing sensor and data gaps
+func (e *Exporter) updateNullFieldMetrics(r *models.MilkingRecord) {
+	// Created unconditionally so that the counters are exposed before the first gap
+	nullSCC := e.set.GetOrCreateCounter(e.naming.LabeledMetricName(models.MetricNullSCC, ""))
+	nullConductivity := e.set.GetOrCreateCounter(e.naming.LabeledMetricName(models.MetricNullConductivity, ""))
 
-		s.GetOrCreateGauge(r.MetricName(models.MetricConductivity), nil).Set(float64(*r.Conductivity))
+	if r.SomaticCellCount == nil {
+		nullSCC.Inc()
+	}
+	if r.Conductivity == nil {
+		nullConductivity.Inc()
+	}
+}
 
-		// Last milking duration with timestamp
-		s.GetOrCreateHistogram(r.MetricName(models.MetricMilkingDuration)).Update(float64(*r.Duration))
-		s.GetOrCreateGauge(r.MetricName(models.MetricLastMilkingDuration), nil).Set(float64(*r.Duration))
-		s.GetOrCreateGauge(r.MetricName(models.MetricLastDurationTimestamp), nil).Set(float64(r.EndTime.Unix()))
+// updateHerdDaysInLactation updates the average days in lactation across animals, excluding those without lactation data
+func (e *Exporter) updateHerdDaysInLactation() {
+	if len(e.daysInLactation) == 0 {
+		return
+	}
 
-		if r.SomaticCellCount != nil {
-			s.GetOrCreateGauge(r.MetricName(models.MetricSomaticCellTotal), nil).Add(float64(*r.SomaticCellCount))
-			// Last somatic cell count with timestamp
-			s.GetOrCreateGauge(r.MetricName(models.MetricLastSomaticCellTotal), nil).Set(float64(*r.SomaticCellCount))
-			s.GetOrCreateGauge(r.MetricName(models.MetricLastSCCTimestamp), nil).Set(float64(r.EndTime.Unix()))
+	total := 0
+	for _, days := range e.daysInLactation {
+		total += days
+	}
+	e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricHerdDaysInLactation, ""), nil).Set(float64(total) / float64(len(e.daysInLactation)))
+}
+
+// updateYieldRange updates the running min/max yield and peak yield time gauges of the record's animal
+func (e *Exporter) updateYieldRange(r *models.MilkingRecord) {
+	key := e.naming.RecordLabels(r)
+	yr, exists := e.yieldRanges[key]
+	if !exists || r.Yield > yr.max {
+		yr.peakAt = r.EndTime
+	}
+	if !exists {
+		yr.min, yr.max = r.Yield, r.Yield
+	}
+	yr.min = min(yr.min, r.Yield)
+	yr.max = max(yr.max, r.Yield)
+	e.yieldRanges[key] = yr
+
+	e.set.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricMinMilkYield), nil).Set(yr.min)
+	e.set.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricMaxMilkYield), nil).Set(yr.max)
+	e.set.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricAnimalPeakYieldTime), nil).Set(float64(yr.peakAt.Unix()))
+}
+
+// updateDeviceYield updates the running average yield per session of the record's device
+func (e *Exporter) updateDeviceYield(r *models.MilkingRecord) {
+	dy := e.deviceYields[r.DeviceID]
+	dy.total += r.Yield
+	dy.sessions++
+	e.deviceYields[r.DeviceID] = dy
+
+	e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricDeviceAvgYield, fmt.Sprintf("milk_device_id=%q", r.DeviceID)), nil).Set(dy.total / float64(dy.sessions))
+}
+
+// updateLastSession sets the last session result metric of the record's animal, removing the previous result series
+func (e *Exporter) updateLastSession(r *models.MilkingRecord) {
+	key := e.naming.RecordLabels(r)
+	name := fmt.Sprintf("%s{%s,result=%q}", models.MetricAnimalLastSession, key, r.SessionResult())
+	if previous, exists := e.lastSessions[key]; exists && previous != name {
+		e.set.UnregisterMetric(previous)
+	}
+	e.lastSessions[key] = name
+
+	e.set.GetOrCreateGauge(name, nil).Set(1)
+}
+
+// updateRecordMetrics updates the per animal metrics of a milking record in the given set
+func (e *Exporter) updateRecordMetrics(s *metrics.Set, r *models.MilkingRecord) {
+	e.updateRecordCounters(s, r)
+
+	// Last milk yield with timestamp
+	s.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricLastMilkYield), nil).Set(r.Yield)
+	s.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricLastYieldTimestamp), nil).Set(float64(r.EndTime.Unix()))
+
+	if r.Conductivity != nil {
+		s.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricConductivity), nil).Set(float64(*r.Conductivity))
+	}
+
+	// Temperature trends hint at fever or mastitis, some devices do not report it
+	if r.Temperature != nil {
+		s.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricTemperature), nil).Set(*r.Temperature)
+		// Last temperature with timestamp
+		s.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricLastTemperature), nil).Set(*r.Temperature)
+		s.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricLastTempTimestamp), nil).Set(float64(r.EndTime.Unix()))
+	}
+
+	// Last milking duration with timestamp, sessions without duration are skipped
+	if r.Duration != nil {
+		s.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricLastMilkingDuration), nil).Set(float64(*r.Duration))
+		s.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricLastDurationTimestamp), nil).Set(float64(r.EndTime.Unix()))
+	}
+
+	if r.SomaticCellCount != nil {
+		// Last somatic cell count with timestamp
+		s.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricLastSomaticCellTotal), nil).Set(float64(*r.SomaticCellCount))
+		s.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricLastSCCTimestamp), nil).Set(float64(r.EndTime.Unix()))
+	}
+
+	e.updateDaysInLactation(s, r)
+
+	// Animals without an open lactation have no lactation summary
+	if r.LactationYield != nil {
+		s.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricLactationYield), nil).Set(*r.LactationYield)
+	}
+
+	// Quarter level data to spot udder imbalance, missing on older records
+	for teat, yield := range r.QuarterYields {
+		s.GetOrCreateGauge(e.naming.TeatMetricName(r, models.MetricQuarterYield, teat.String()), nil).Set(yield)
+	}
+	for teat, flow := range r.QuarterPeakFlows {
+		s.GetOrCreateGauge(e.naming.TeatMetricName(r, models.MetricQuarterPeakFlow, teat.String()), nil).Set(flow)
+	}
+
+	if e.animalNumberMetric {
+		e.updateAnimalNumber(s, r)
+	}
+}
+
+// updateRecordCounters accumulates a milking record into the per animal counters, totals and duration histogram
+func (e *Exporter) updateRecordCounters(s *metrics.Set, r *models.MilkingRecord) {
+	s.GetOrCreateCounter(e.naming.RecordMetricName(r, models.MetricMilkSessions)).Inc()
+	s.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricMilkYieldTotal), nil).Add(r.Yield)
+
+	// Sample count allows computing proper conductivity averages
+	if r.Conductivity != nil {
+		s.GetOrCreateCounter(e.naming.RecordMetricName(r, models.MetricConductivitySamples)).Inc()
+	}
+
+	if r.Duration != nil {
+		if e.histogram == HistogramPrometheus {
+			s.GetOrCreatePrometheusHistogramExt(e.naming.RecordMetricName(r, models.MetricMilkingDuration), durationBuckets).Update(float64(*r.Duration))
+		} else {
+			s.GetOrCreateHistogram(e.naming.RecordMetricName(r, models.MetricMilkingDuration)).Update(float64(*r.Duration))
+		}
+
+		// Total milking time for equipment occupancy analysis, negative durations of inconsistent sessions would wrap the counter
+		if *r.Duration > 0 {
+			s.GetOrCreateCounter(e.naming.RecordMetricName(r, models.MetricTotalMilkingTime)).Add(*r.Duration)
 		}
+	}
 
+	// A long session without milk points to an equipment failure or a cow that did not let down
+	if e.isZeroYieldLong(r) {
+		s.GetOrCreateCounter(e.naming.RecordMetricName(r, models.MetricZeroYieldLong)).Inc()
+	}
+
+	if r.SomaticCellCount != nil {
+		s.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricSomaticCellTotal), nil).Add(float64(*r.SomaticCellCount))
+	}
+
+	for _, name := range e.teatCounterNames(r) {
+		s.GetOrCreateCounter(name).Inc()
+	}
+}
+
+// updateAnimalNumber exposes the animal number as a value, as string labels do not allow numeric comparisons
+// Animal numbers that are not numeric are skipped
+func (e *Exporter) updateAnimalNumber(s *metrics.Set, r *models.MilkingRecord) {
+	number, err := strconv.ParseFloat(r.AnimalNumber, 64)
+	if err != nil {
+		return
+	}
+	s.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricAnimalNumber, fmt.Sprintf("animal_reg_no=%q", r.AnimalRegNo)), nil).Set(number)
+}
+
+// isZeroYieldLong reports whether a record has no yield and lasted at least the zero yield duration threshold
+func (e *Exporter) isZeroYieldLong(r *models.MilkingRecord) bool {
+	if r.Yield != 0 || r.Duration == nil {
+		return false
+	}
+	return time.Duration(*r.Duration)*time.Second >= e.zeroYieldMinDuration
+}
+
+// updateDaysInLactation sets the days in lactation gauge, animals without an open lactation following the missing lactation behavior
+func (e *Exporter) updateDaysInLactation(s *metrics.Set, r *models.MilkingRecord) {
+	switch e.lactation {
+	case MissingLactationSentinel:
+		days := -1.0
 		if r.DaysInLactation != nil {
-			s.GetOrCreateGauge(r.MetricName(models.MetricDaysInLactation), nil).Set(float64(*r.DaysInLactation))
+			days = float64(*r.DaysInLactation)
 		}
+		s.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricDaysInLactation), nil).Set(days)
+	case MissingLactationLabel:
+		withLactation := fmt.Sprintf("%s{%s,has_lactation=\"true\"}", models.MetricDaysInLactation, e.naming.RecordLabels(r))
+		withoutLactation := fmt.Sprintf("%s{%s,has_lactation=\"false\"}", models.MetricDaysInLactation, e.naming.RecordLabels(r))
+		// Only one of both series is exposed at a time
+		if r.DaysInLactation != nil {
+			s.UnregisterMetric(withoutLactation)
+			s.GetOrCreateGauge(withLactation, nil).Set(float64(*r.DaysInLactation))
+		} else {
+			s.UnregisterMetric(withLactation)
+			s.GetOrCreateGauge(withoutLactation, nil).Set(0)
+		}
+	default:
+		if r.DaysInLactation != nil {
+			s.GetOrCreateGauge(e.naming.RecordMetricName(r, models.MetricDaysInLactation), nil).Set(float64(*r.DaysInLactation))
+		}
+	}
+}
+
+// teatCounterNames returns the incomplete and kickoff teat counter names affected by a record
+// Records without incomplete or kickoff data affect none of the corresponding counters
+func (e *Exporter) teatCounterNames(r *models.MilkingRecord) []string {
+	var names []string
+	perTeat := e.teatStyle == TeatStylePerTeat || e.teatStyle == TeatStyleBoth
+	combined := e.teatStyle == TeatStyleCombined || e.teatStyle == TeatStyleBoth
 
-		for _, teat := range models.GetAffectedTeats(*r.Incomplete) {
-			s.GetOrCreateGauge(r.TeatMetricName(models.MetricIncomplete, teat), nil).Inc()
+	if r.Incomplete != nil {
+		names = append(names, e.affectedTeatNames(r, *r.Incomplete, models.MetricIncomplete, models.MetricIncompleteTeats, perTeat, combined)...)
+	}
+	if r.Kickoff != nil {
+		names = append(names, e.affectedTeatNames(r, *r.Kickoff, models.MetricKickoff, models.MetricKickoffTeats, perTeat, combined)...)
+	}
+
+	return names
+}
+
+// affectedTeatNames returns the per teat and combined counter names of the teats flagged in a bitmask
+func (e *Exporter) affectedTeatNames(r *models.MilkingRecord, mask int, teatMetric, teatsMetric string, perTeat, combined bool) []string {
+	var names []string
+	if perTeat {
+		for _, teat := range models.GetAffectedTeats(mask) {
+			names = append(names, e.naming.TeatMetricName(r, teatMetric, teat))
 		}
-		// Add concatenated teats metric for easier Grafana visualization
-		incompleteTeats := models.GetAffectedTeatsString(*r.Incomplete)
-		if incompleteTeats != "none" {
-			s.GetOrCreateGauge(r.TeatsMetricName(models.MetricIncompleteTeats, incompleteTeats), nil).Inc()
+	}
+
+	// Concatenated teats metrics for easier Grafana visualization
+	if combined {
+		if teats := models.GetAffectedTeatsString(mask); teats != "none" {
+			names = append(names, e.naming.TeatsMetricName(r, teatsMetric, teats))
 		}
+	}
+	return names
+}
+
+// CreateDeviceUtilizationMetrics creates device utilization metrics
+func (e *Exporter) CreateDeviceUtilizationMetrics(utilization map[string]models.DeviceUtilization) {
+	for deviceID, u := range utilization {
+		labels := fmt.Sprintf("milk_device_id=%q", deviceID)
+		e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricDeviceUtilization, labels), nil).Set(float64(u.Sessions))
+
+		// Equipment health indicator, devices are only listed when they had sessions
+		if u.Sessions > 0 {
+			e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricDeviceIncompleteRatio, labels), nil).Set(float64(u.IncompleteSessions) / float64(u.Sessions))
+		}
+	}
+
+	e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricActiveDevices, ""), nil).Set(float64(len(utilization)))
+
+	if imbalance, ok := loadImbalance(utilization); ok {
+		e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricDeviceLoadImbalance, ""), nil).Set(imbalance)
+	}
+}
+
+// loadImbalance returns the coefficient of variation of the session counts of the devices, the population
+// standard deviation divided by the mean, which is undefined without sessions
+func loadImbalance(utilization map[string]models.DeviceUtilization) (float64, bool) {
+	var total float64
+	for _, u := range utilization {
+		total += float64(u.Sessions)
+	}
+	if total == 0 {
+		return 0, false
+	}
+	mean := total / float64(len(utilization))
+
+	var variance float64
+	for _, u := range utilization {
+		d := float64(u.Sessions) - mean
+		variance += d * d
+	}
+	variance /= float64(len(utilization))
+
+	return math.Sqrt(variance) / mean, true
+}
 
-		for _, teat := range models.GetAffectedTeats(*r.Kickoff) {
-			s.GetOrCreateGauge(r.TeatMetricName(models.MetricKickoff, teat), nil).Inc()
+// CreateDriedOffMetrics flags animals with an open lactation that had no session since cutoff
+// Animals no longer lactating are dropped, as they left the herd or their lactation was closed
+func (e *Exporter) CreateDriedOffMetrics(animals []models.LactatingAnimal, cutoff time.Time) {
+	current := make(map[string]bool, len(animals))
+	for _, a := range animals {
+		labels := fmt.Sprintf("animal_number=%q,animal_name=%q,animal_reg_no=%q", a.AnimalNumber, a.AnimalName, a.AnimalRegNo)
+		name := e.naming.LabeledMetricName(models.MetricAnimalDriedOff, labels)
+		current[name] = true
+
+		value := 0.0
+		if a.DriedOff(cutoff) {
+			value = 1
 		}
-		// Add concatenated teats metric for easier Grafana visualization
-		kickoffTeats := models.GetAffectedTeatsString(*r.Kickoff)
-		if kickoffTeats != "none" {
-			s.GetOrCreateGauge(r.TeatsMetricName(models.MetricKickoffTeats, kickoffTeats), nil).Inc()
+		e.set.GetOrCreateGauge(name, nil).Set(value)
+	}
+
+	for name := range e.driedOff {
+		if !current[name] {
+			e.set.UnregisterMetric(name)
 		}
+	}
+	e.driedOff = current
+}
 
-		if w != nil {
-			s.WritePrometheus(NewTimestampWriter(w, r.EndTime))
+// CreateWeightMetrics sets the latest weight of each weighed animal, dropping animals that were not weighed recently
+func (e *Exporter) CreateWeightMetrics(weights []models.WeightRecord) {
+	current := make(map[string]bool, len(weights))
+	for _, w := range weights {
+		labels := fmt.Sprintf("animal_number=%q,animal_name=%q,animal_reg_no=%q", w.AnimalNumber, w.AnimalName, w.AnimalRegNo)
+		name := e.naming.LabeledMetricName(models.MetricAnimalWeight, labels)
+		current[name] = true
+		e.set.GetOrCreateGauge(name, nil).Set(w.Weight)
+	}
+
+	for name := range e.weights {
+		if !current[name] {
+			e.set.UnregisterMetric(name)
 		}
 	}
+	e.weights = current
 }
 
-// CreateDeviceUtilizationMetrics creates device utilization metrics
-func (e *Exporter) CreateDeviceUtilizationMetrics(utilization map[string]int) {
-	for deviceID, sessionCount := range utilization {
-		metrics.GetOrCreateGauge(fmt.Sprintf("%s{milk_device_id=%q,data_format_version=%q}", models.MetricDeviceUtilization, deviceID, models.DataFormatVersion), nil).Set(float64(sessionCount))
+// RemoveAnimal unregisters the series of an animal and forgets its running state, returning the number of removed series
+// Series are matched on their animal_number label, as registration numbers are not unique: missing ones read Unknown
+// Dried-off flags are kept, as they are maintained for animals that are no longer milked
+func (e *Exporter) RemoveAnimal(animalNumber, animalRegNo string) int {
+	belongs := func(name string) bool {
+		return hasLabel(name, "animal_number", animalNumber)
 	}
+
+	removed := 0
+	for _, name := range e.set.ListMetricNames() {
+		if belongs(name) && !strings.HasPrefix(name, models.MetricAnimalDriedOff+"{") && e.set.UnregisterMetric(name) {
+			removed++
+		}
+	}
+
+	// The animal number metric is only labeled by registration number, it is removed when it holds this animal's number
+	numberName := e.naming.LabeledMetricName(models.MetricAnimalNumber, fmt.Sprintf("animal_reg_no=%q", animalRegNo))
+	if number, err := strconv.ParseFloat(animalNumber, 64); err == nil && slices.Contains(e.set.ListMetricNames(), numberName) {
+		if e.set.GetOrCreateGauge(numberName, nil).Get() == number && e.set.UnregisterMetric(numberName) {
+			removed++
+		}
+	}
+
+	for key := range e.yieldRanges {
+		if belongs(key) {
+			delete(e.yieldRanges, key)
+		}
+	}
+	for key := range e.lastSessions {
+		if belongs(key) {
+			delete(e.lastSessions, key)
+		}
+	}
+	if _, exists := e.daysInLactation[animalNumber]; exists {
+		delete(e.daysInLactation, animalNumber)
+		e.updateHerdDaysInLactation()
+	}
+
+	return removed
+}
+
+// hasLabel reports whether a metric name or label string holds a label with exactly the given value
+// Label values are quoted and cleaned from quotes, so that a quoted pair cannot match a longer value
+func hasLabel(name, label, value string) bool {
+	pair := fmt.Sprintf("%s=%q", label, value)
+	return strings.HasPrefix(name, pair) || strings.Contains(name, "{"+pair) || strings.Contains(name, ","+pair)
+}
+
+// SetTotalSessions records the number of milking sessions in the database
+func (e *Exporter) SetTotalSessions(total int64) {
+	e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricDBTotalSessions, ""), nil).Set(float64(total))
+}
+
+// SetScrapeResult records the duration and outcome of a database collection phase
+func (e *Exporter) SetScrapeResult(collector string, d time.Duration, success bool) {
+	labels := fmt.Sprintf("collector=%q", collector)
+
+	value := 0.0
+	if success {
+		value = 1
+		e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricLastSuccessfulScrape, labels), nil).Set(float64(time.Now().Unix()))
+	}
+	e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricScrapeSuccess, labels), nil).Set(value)
+	e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricScrapeDuration, labels), nil).Set(d.Seconds())
+}
+
+// SetDBConnected records whether the database connection could be established
+func (e *Exporter) SetDBConnected(connected bool) {
+	value := 0.0
+	if connected {
+		value = 1
+	}
+	e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricDBConnected, ""), nil).Set(value)
+}
+
+// CreateConnectionPoolMetrics creates database connection pool metrics
+func (e *Exporter) CreateConnectionPoolMetrics(stats sql.DBStats) {
+	e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricDBConnectionsOpen, ""), nil).Set(float64(stats.OpenConnections))
+	e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricDBConnectionsInUse, ""), nil).Set(float64(stats.InUse))
+	e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricDBConnectionsIdle, ""), nil).Set(float64(stats.Idle))
+}
+
+// CreateConfigMetrics creates one configuration info metric per setting
+func (e *Exporter) CreateConfigMetrics(settings []models.ConfigSetting) {
+	for _, setting := range settings {
+		labels := fmt.Sprintf("flag=%q,value=%q,source=%q", setting.Name, setting.Value, setting.Source)
+		e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricExporterConfig, labels), nil).Set(1)
+	}
+}
+
+// SetHeartbeat records the time of a metrics update, whether it succeeded and found new records or not
+func (e *Exporter) SetHeartbeat(t time.Time) {
+	e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricExporterHeartbeat, ""), nil).Set(float64(t.Unix()))
+}
+
+// SetRuntimeMetrics records the goroutine count and heap size, a small alternative to the full process metrics
+func (e *Exporter) SetRuntimeMetrics() {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricExporterGoroutines, ""), nil).Set(float64(runtime.NumGoroutine()))
+	e.set.GetOrCreateGauge(e.naming.LabeledMetricName(models.MetricExporterHeapBytes, ""), nil).Set(float64(ms.HeapAlloc))
+}
+
+// ObserveUpdateDuration records the duration of a live metrics update
+func (e *Exporter) ObserveUpdateDuration(d time.Duration) {
+	name := e.naming.LabeledMetricName(models.MetricUpdateDuration, "")
+	if e.histogram == HistogramPrometheus {
+		e.set.GetOrCreatePrometheusHistogramExt(name, updateDurationBuckets).Update(d.Seconds())
+	} else {
+		e.set.GetOrCreateHistogram(name).Update(d.Seconds())
+	}
+}
+
+// manualInterventionName returns the manual intervention counter name of a milking device
+func (e *Exporter) manualInterventionName(deviceID string) string {
+	return e.naming.LabeledMetricName(models.MetricManualIntervention, fmt.Sprintf("milk_device_id=%q", deviceID))
+}
+
+// hourMetricName returns the sessions by hour metric name for the hour of day of t in the exporter location
+func (e *Exporter) hourMetricName(t time.Time) string {
+	return e.naming.LabeledMetricName(models.MetricSessionsByHour, fmt.Sprintf("hour=\"%02d\"", t.In(e.location).Hour()))
 }
 
 // WriteHistoricalMetricsWithInit writes historical metrics with timestamps, with counter resets before and after
-func (e *Exporter) WriteHistoricalMetricsWithInit(w io.Writer, records []*models.MilkingRecord) {
+func (e *Exporter) WriteHistoricalMetricsWithInit(w io.Writer, records []*models.MilkingRecord) error {
 	// First, write counter reset values before the first records
 	e.writeCounterResetValues(w, records, true) // true = before first record
 
 	// Then write the actual historical metrics
-	e.WriteHistoricalMetrics(w, records)
+	if err := e.WriteHistoricalMetrics(w, records); err != nil {
+		return err
+	}
 
 	// Finally, write counter reset values after the last records
 	e.writeCounterResetValues(w, records, false) // false = after last record
+	return nil
 }
 
 // writeCounterResetValues writes 0 values with timestamps before first or after last record for each unique animal
@@ -179,10 +820,22 @@ func (e *Exporter) writeCounterResetValues(w io.Writer, records []*models.Milkin
 	// Track unique animals to avoid duplicate initializations
 	seenAnimals := make(map[string]*models.MilkingRecord)
 
+	// Track the teat counters of each animal, only those series need a reset
+	teatCounters := make(map[string]map[string]bool)
+	for _, record := range records {
+		key := e.naming.RecordLabels(record)
+		for _, name := range e.teatCounterNames(record) {
+			if teatCounters[key] == nil {
+				teatCounters[key] = make(map[string]bool)
+			}
+			teatCounters[key][name] = true
+		}
+	}
+
 	if beforeFirst {
 		// Find the first (earliest) record for each unique animal
 		for _, record := range records {
-			key := record.LabelStr()
+			key := e.naming.RecordLabels(record)
 			if existing, exists := seenAnimals[key]; !exists || record.EndTime.Before(existing.EndTime) {
 				seenAnimals[key] = record
 			}
@@ -190,15 +843,16 @@ func (e *Exporter) writeCounterResetValues(w io.Writer, records []*models.Milkin
 	} else {
 		// Find the last (latest) record for each unique animal
 		for _, record := range records {
-			key := record.LabelStr()
+			key := e.naming.RecordLabels(record)
 			if existing, exists := seenAnimals[key]; !exists || record.EndTime.After(existing.EndTime) {
 				seenAnimals[key] = record
 			}
 		}
 	}
 
-	// Write counter reset values for each unique animal
-	for _, targetRecord := range seenAnimals {
+	// Write counter reset values for each unique animal, in a stable order
+	for _, key := range slices.Sorted(maps.Keys(seenAnimals)) {
+		targetRecord := seenAnimals[key]
 		var resetTimestamp time.Time
 		if beforeFirst {
 			// Create timestamp 10 minutes before the first record
@@ -210,12 +864,18 @@ func (e *Exporter) writeCounterResetValues(w io.Writer, records []*models.Milkin
 		timestampMs := resetTimestamp.UnixMilli()
 
 		// Write zero values to reset counters
-		fmt.Fprintf(w, "%s 0 %d\n", targetRecord.MetricName(models.MetricMilkSessions), timestampMs)
-		fmt.Fprintf(w, "%s 0 %d\n", targetRecord.MetricName(models.MetricMilkYieldTotal), timestampMs)
-		fmt.Fprintf(w, "%s 0 %d\n", targetRecord.MetricName(models.MetricSomaticCellTotal), timestampMs)
+		fmt.Fprintf(w, "%s 0 %d\n", e.naming.RecordMetricName(targetRecord, models.MetricMilkSessions), timestampMs)
+		fmt.Fprintf(w, "%s 0 %d\n", e.naming.RecordMetricName(targetRecord, models.MetricMilkYieldTotal), timestampMs)
+		fmt.Fprintf(w, "%s 0 %d\n", e.naming.RecordMetricName(targetRecord, models.MetricSomaticCellTotal), timestampMs)
+		fmt.Fprintf(w, "%s 0 %d\n", e.naming.RecordMetricName(targetRecord, models.MetricConductivitySamples), timestampMs)
+		fmt.Fprintf(w, "%s 0 %d\n", e.naming.RecordMetricName(targetRecord, models.MetricZeroYieldLong), timestampMs)
+		fmt.Fprintf(w, "%s 0 %d\n", e.naming.RecordMetricName(targetRecord, models.MetricTotalMilkingTime), timestampMs)
+		for _, name := range slices.Sorted(maps.Keys(teatCounters[key])) {
+			fmt.Fprintf(w, "%s 0 %d\n", name, timestampMs)
+		}
 
 		// Write zero histogram for milking duration
-		e.writeZeroHistogram(w, targetRecord.MetricName(models.MetricMilkingDuration), timestampMs)
+		e.writeZeroHistogram(w, e.naming.RecordMetricName(targetRecord, models.MetricMilkingDuration), timestampMs)
 	}
 }
 
@@ -247,7 +907,10 @@ func splitMetricName(metricName string) (string, string) {
 
 // WriteHistoricalMetrics writes metrics with timestamps in Prometheus exposition format
 // Uses one metric set per animal to avoid duplicate data when no changes occur
-func (e *Exporter) WriteHistoricalMetrics(w io.Writer, records []*models.MilkingRecord) {
+// Historical metrics are always computed in fresh isolated sets and never touch the live metric set,
+// so that historical requests overlapping the live OID watermark cannot alter live counters
+// Output is deterministic: animals are written by registration number, and their records by end time and OID
+func (e *Exporter) WriteHistoricalMetrics(w io.Writer, records []*models.MilkingRecord) error {
 	// Group records by animal registration number
 	animalRecords := make(map[string][]*models.MilkingRecord)
 	for _, record := range records {
@@ -255,8 +918,32 @@ func (e *Exporter) WriteHistoricalMetrics(w io.Writer, records []*models.Milking
 	}
 
 	// Process each animal's records separately
-	for _, animalData := range animalRecords {
-		s := metrics.NewSet()
-		e.CreateMetricsFromRecords(s, w, animalData)
+	for _, regNo := range slices.Sorted(maps.Keys(animalRecords)) {
+		animalData := animalRecords[regNo]
+		slices.SortFunc(animalData, compareRecords)
+		if err := e.writeAnimalMetrics(w, animalData); err != nil {
+			return err
+		}
 	}
+	return nil
+}
+
+// compareRecords orders milking records by end time, then by OID
+func compareRecords(a, b *models.MilkingRecord) int {
+	return cmp.Or(a.EndTime.Compare(b.EndTime), cmp.Compare(a.OID, b.OID))
+}
+
+// writeAnimalMetrics writes the timestamped metrics of a single animal's records using an isolated set
+func (e *Exporter) writeAnimalMetrics(w io.Writer, records []*models.MilkingRecord) error {
+	s := metrics.NewSet()
+	for _, r := range records {
+		e.updateRecordMetrics(s, r)
+
+		tw := NewTimestampWriter(w, r.EndTime)
+		s.WritePrometheus(tw)
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,1199 @@
+package metrics
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/metrics"
+	"github.com/clementnuss/delpro-exporter/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestTimestampWriter(t *testing.T) {
+	ts := time.UnixMilli(1714543200000)
+
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{
+			name:   "trailing newline",
+			writes: []string{"delpro_milk_yield_liters{animal_number=\"1\"} 12.5\n"},
+			want:   "delpro_milk_yield_liters{animal_number=\"1\"} 12.5 1714543200000\n",
+		},
+		{
+			name:   "final line without trailing newline",
+			writes: []string{"delpro_milk_sessions_total{animal_number=\"1\"} 3\ndelpro_milk_yield_liters{animal_number=\"1\"} 12.5"},
+			want: "delpro_milk_sessions_total{animal_number=\"1\"} 3 1714543200000\n" +
+				"delpro_milk_yield_liters{animal_number=\"1\"} 12.5 1714543200000\n",
+		},
+		{
+			name:   "line split across writes",
+			writes: []string{"delpro_milk_last_yield_timestamp{animal_number=\"1\"} 1.7145", "432e+09"},
+			want:   "delpro_milk_last_yield_timestamp{animal_number=\"1\"} 1714543200 1714543200000\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			tw := NewTimestampWriter(&out, ts)
+			for _, w := range tt.writes {
+				if _, err := tw.Write([]byte(w)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tw.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("output:\n%s\nwant:\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+// testRecord returns a milking record of animal 1 with the given yield, ending at end
+func testRecord(oid int64, yield float64, end time.Time) *models.MilkingRecord {
+	return &models.MilkingRecord{
+		OID: oid, AnimalNumber: "1", AnimalName: "Bella", AnimalRegNo: "CH1", BreedName: "Holstein", BreedID: "1",
+		DeviceID: "1", DestinationName: "Tank", Yield: yield, BeginTime: end.Add(-8 * time.Minute), EndTime: end,
+	}
+}
+
+// exposition returns the Prometheus exposition of the exporter set
+func exposition(e *Exporter) string {
+	var out bytes.Buffer
+	e.Set().WritePrometheus(&out)
+	return out.String()
+}
+
+// sample returns the value of the first sample of metric holding all the given `name="value"` label pairs
+func sample(output, metric string, labels ...string) (string, bool) {
+	for _, line := range strings.Split(output, "\n") {
+		series, value, found := strings.Cut(line, " ")
+		if j := strings.LastIndex(line, "}"); j != -1 {
+			series, value, found = line[:j+1], strings.TrimSpace(line[j+1:]), true
+		}
+		name, labelStr, _ := strings.Cut(series, "{")
+		if !found || name != metric {
+			continue
+		}
+		matches := true
+		for _, label := range labels {
+			key, labelValue, _ := strings.Cut(label, "=")
+			matches = matches && hasLabel(labelStr, key, strings.Trim(labelValue, `"`))
+		}
+		if matches {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func TestVersionLabel(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		e := NewExporter(metrics.NewSet(), Config{Location: time.UTC, VersionLabel: enabled})
+		e.CreateMetricsFromRecords([]*models.MilkingRecord{testRecord(1, 12.5, time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC))})
+
+		version := fmt.Sprintf("data_format_version=%q", models.DataFormatVersion)
+		for _, line := range strings.Split(strings.TrimSpace(exposition(e)), "\n") {
+			// The info metric always carries the version
+			if strings.HasPrefix(line, "#") || strings.HasPrefix(line, models.MetricExporterInfo) {
+				continue
+			}
+			if strings.Contains(line, version) != enabled {
+				t.Errorf("version label enabled = %t, line %q", enabled, line)
+			}
+		}
+	}
+}
+
+func TestDataFormatVersionConsistent(t *testing.T) {
+	if !regexp.MustCompile(`^[0-9]+\.[0-9]+\.[0-9]+$`).MatchString(models.DataFormatVersion) {
+		t.Fatalf("data format version %q is not a semantic version", models.DataFormatVersion)
+	}
+
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC, VersionLabel: true})
+	e.CreateMetricsFromRecords([]*models.MilkingRecord{testRecord(1, 12.5, time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC))})
+	output := exposition(e)
+
+	// The info metric and the labels of every metric report the same version
+	versions := make(map[string]bool)
+	for _, match := range regexp.MustCompile(`data_format_version="([^"]*)"`).FindAllStringSubmatch(output, -1) {
+		versions[match[1]] = true
+	}
+	if len(versions) != 1 || !versions[models.DataFormatVersion] {
+		t.Errorf("versions %v, want only %s", versions, models.DataFormatVersion)
+	}
+	info := fmt.Sprintf("%s{data_format_version=%q} 1", models.MetricExporterInfo, models.DataFormatVersion)
+	if !strings.Contains(output, info) {
+		t.Errorf("output lacks %s:\n%s", info, output)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	const exposition = `# TYPE delpro_milk_sessions_total counter
+delpro_milk_sessions_total{animal_number="1"} 3
+# TYPE delpro_milk_yield_liters gauge
+delpro_milk_yield_liters{animal_number="1"} 12.5
+# TYPE delpro_milk_duration_seconds histogram
+delpro_milk_duration_seconds_bucket{le="300"} 1
+delpro_milk_duration_seconds_bucket{le="600"} 2
+delpro_milk_duration_seconds_bucket{le="+Inf"} 3
+delpro_milk_duration_seconds_sum 1500
+delpro_milk_duration_seconds_count 3
+`
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewCollector(func(w io.Writer) error {
+		_, err := io.WriteString(w, exposition)
+		return err
+	}))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The gathered families are written back in the same text format
+	var out bytes.Buffer
+	for _, family := range families {
+		if _, err := expfmt.MetricFamilyToText(&out, family); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{
+		"# TYPE delpro_milk_sessions_total counter",
+		`delpro_milk_sessions_total{animal_number="1"} 3`,
+		"# TYPE delpro_milk_yield_liters gauge",
+		`delpro_milk_yield_liters{animal_number="1"} 12.5`,
+		"# TYPE delpro_milk_duration_seconds histogram",
+		`delpro_milk_duration_seconds_bucket{le="600"} 2`,
+		`delpro_milk_duration_seconds_bucket{le="+Inf"} 3`,
+		"delpro_milk_duration_seconds_sum 1500",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("gathered metrics lack %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestCollectorWriteError(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewCollector(func(io.Writer) error { return errors.New("database unavailable") }))
+	if _, err := registry.Gather(); err == nil || !strings.Contains(err.Error(), "database unavailable") {
+		t.Fatalf("err = %v, want the write error", err)
+	}
+}
+
+func TestLactationYield(t *testing.T) {
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	open := testRecord(1, 12.5, end)
+	lactation, days, total := 3, 120, 4520.5
+	open.LactationNumber, open.DaysInLactation, open.LactationYield = &lactation, &days, &total
+
+	// Animals without an open lactation have no lactation summary row
+	closed := testRecord(2, 10, end)
+	closed.AnimalNumber, closed.AnimalRegNo = "2", "CH2"
+
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	e.CreateMetricsFromRecords([]*models.MilkingRecord{open, closed})
+	output := exposition(e)
+
+	if value, _ := sample(output, models.MetricLactationYield, `animal_number="1"`, `lactation="3"`); value != "4520.5" {
+		t.Errorf("lactation yield of animal 1 = %q, want 4520.5:\n%s", value, output)
+	}
+	if value, found := sample(output, models.MetricLactationYield, `animal_number="2"`); found {
+		t.Errorf("lactation yield of animal 2 without lactation = %s, want none", value)
+	}
+}
+
+func TestSessionsByHour(t *testing.T) {
+	cest := time.FixedZone("CEST", 2*60*60)
+	records := []*models.MilkingRecord{
+		testRecord(1, 10, time.Date(2024, 5, 1, 4, 30, 0, 0, time.UTC)),  // 06:30 local
+		testRecord(2, 11, time.Date(2024, 5, 1, 4, 59, 0, 0, time.UTC)),  // 06:59 local
+		testRecord(3, 12, time.Date(2024, 5, 1, 5, 0, 0, 0, time.UTC)),   // 07:00 local
+		testRecord(4, 13, time.Date(2024, 5, 1, 22, 30, 0, 0, time.UTC)), // 00:30 local, the next day
+	}
+
+	tests := []struct {
+		location *time.Location
+		want     map[string]string
+	}{
+		{time.UTC, map[string]string{"04": "2", "05": "1", "22": "1"}},
+		{cest, map[string]string{"06": "2", "07": "1", "00": "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.location.String(), func(t *testing.T) {
+			e := NewExporter(metrics.NewSet(), Config{Location: tt.location})
+			e.CreateMetricsFromRecords(records)
+			output := exposition(e)
+
+			for hour := range 24 {
+				label := fmt.Sprintf("hour=\"%02d\"", hour)
+				value, found := sample(output, models.MetricSessionsByHour, label)
+				if want := tt.want[fmt.Sprintf("%02d", hour)]; value != want || found != (want != "") {
+					t.Errorf("sessions at %s = %q, want %q", label, value, want)
+				}
+			}
+		})
+	}
+}
+
+func TestActiveDevices(t *testing.T) {
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	for _, utilization := range []map[string]models.DeviceUtilization{
+		{"1": {Sessions: 120}, "2": {Sessions: 95}, "3": {Sessions: 101}},
+		{"1": {Sessions: 130}},
+		{},
+	} {
+		e.CreateDeviceUtilizationMetrics(utilization)
+		if value, _ := sample(exposition(e), models.MetricActiveDevices); value != fmt.Sprint(len(utilization)) {
+			t.Errorf("active devices = %q, want %d", value, len(utilization))
+		}
+	}
+}
+
+func TestInfluxWriter(t *testing.T) {
+	input := `# HELP delpro_milk_yield_liters Milk yield of the last session in liters
+# TYPE delpro_milk_yield_liters gauge
+delpro_milk_yield_liters{animal_number="1",animal_name="Bella, the 2nd",destination="Tank A=1"} 12.5 1714543200000
+delpro_exporter_start_time_seconds 1714540000 1714543200000
+
+delpro_milk_sessions_total{animal_number="2",animal_name="Say \"hi\""} 3 1714543200000`
+	want := `delpro_milk_yield_liters,animal_number=1,animal_name=Bella\,\ the\ 2nd,destination=Tank\ A\=1 value=12.5 1714543200000000000
+delpro_exporter_start_time_seconds value=1714540000 1714543200000000000
+delpro_milk_sessions_total,animal_number=2,animal_name=Say\ "hi" value=3 1714543200000000000
+`
+
+	var out bytes.Buffer
+	iw := NewInfluxWriter(&out)
+	if _, err := io.WriteString(iw, input); err != nil {
+		t.Fatal(err)
+	}
+	if err := iw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	// Line protocol requires timestamps
+	if _, err := io.WriteString(NewInfluxWriter(&out), "delpro_milk_yield_liters 12.5\n"); err == nil {
+		t.Error("line without timestamp accepted")
+	}
+}
+
+func TestInjectedSet(t *testing.T) {
+	r := testRecord(1, 12.5, time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC))
+	r.AnimalNumber = "injected"
+
+	set := metrics.NewSet()
+	e := NewExporter(set, Config{Location: time.UTC})
+	e.CreateMetricsFromRecords([]*models.MilkingRecord{r})
+
+	if value, _ := sample(exposition(e), models.MetricLastMilkYield, `animal_number="injected"`); value != "12.5" {
+		t.Errorf("injected set yield = %q, want 12.5", value)
+	}
+	var global bytes.Buffer
+	metrics.GetDefaultSet().WritePrometheus(&global)
+	if strings.Contains(global.String(), `animal_number="injected"`) {
+		t.Errorf("record metrics leaked into the default set:\n%s", global.String())
+	}
+}
+
+func TestExporterStartTimestamp(t *testing.T) {
+	before := time.Now().Unix()
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	after := time.Now().Unix()
+
+	value, found := sample(exposition(e), models.MetricExporterStart)
+	if !found {
+		t.Fatal("start timestamp not exposed")
+	}
+	start, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(start) < before || int64(start) > after {
+		t.Errorf("start timestamp = %s, want between %d and %d", value, before, after)
+	}
+}
+
+func TestHistoricalDoesNotMutateLiveSet(t *testing.T) {
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	e.CreateMetricsFromRecords([]*models.MilkingRecord{testRecord(1, 12.5, end)})
+	live := exposition(e)
+
+	// The historical range overlaps the live watermark
+	var out bytes.Buffer
+	records := []*models.MilkingRecord{testRecord(1, 12.5, end), testRecord(2, 10, end.Add(12*time.Hour))}
+	if err := e.WriteHistoricalMetricsWithInit(&out, records); err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`(?m)^` + models.MetricMilkSessions + `\{[^}]*\} 2 1714586400000$`).MatchString(out.String()) {
+		t.Errorf("historical output lacks 2 sessions at the last record:\n%s", out.String())
+	}
+	if after := exposition(e); after != live {
+		t.Errorf("live metrics changed by historical request:\nbefore:\n%s\nafter:\n%s", live, after)
+	}
+}
+
+func TestYieldRange(t *testing.T) {
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		yield    float64
+		min, max string
+	}{
+		{12, "12", "12"},
+		{9, "9", "12"},
+		{15.5, "9", "15.5"},
+		{11, "9", "15.5"},
+	}
+	for i, tt := range tests {
+		e.CreateMetricsFromRecords([]*models.MilkingRecord{testRecord(int64(i+1), tt.yield, end.Add(time.Duration(i)*12*time.Hour))})
+		output := exposition(e)
+
+		if value, _ := sample(output, models.MetricMinMilkYield, `animal_number="1"`); value != tt.min {
+			t.Errorf("after yield %v: min = %q, want %s", tt.yield, value, tt.min)
+		}
+		if value, _ := sample(output, models.MetricMaxMilkYield, `animal_number="1"`); value != tt.max {
+			t.Errorf("after yield %v: max = %q, want %s", tt.yield, value, tt.max)
+		}
+	}
+}
+
+func TestPeakYieldTime(t *testing.T) {
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	start := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+
+	// The timestamp only moves when a session beats the peak, an equal yield keeps the first peak
+	tests := []struct {
+		yield float64
+		peak  int
+	}{
+		{12, 0},
+		{15.5, 1},
+		{11, 1},
+		{15.5, 1},
+		{16, 4},
+	}
+	for i, tt := range tests {
+		e.CreateMetricsFromRecords([]*models.MilkingRecord{testRecord(int64(i+1), tt.yield, start.Add(time.Duration(i)*12*time.Hour))})
+
+		want := strconv.FormatInt(start.Add(time.Duration(tt.peak)*12*time.Hour).Unix(), 10)
+		if value, _ := sample(exposition(e), models.MetricAnimalPeakYieldTime, `animal_number="1"`); value != want {
+			t.Errorf("after session %d yielding %v: peak yield time = %q, want %s", i, tt.yield, value, want)
+		}
+	}
+}
+
+func TestTeatCounters(t *testing.T) {
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	leftFront, leftFrontAndRear := int(models.LeftFront), int(models.LeftFront|models.LeftRear)
+	first, second := testRecord(1, 10, end), testRecord(2, 11, end.Add(12*time.Hour))
+	first.Incomplete, second.Incomplete = &leftFrontAndRear, &leftFront
+
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	e.CreateMetricsFromRecords([]*models.MilkingRecord{first, second})
+	output := exposition(e)
+
+	// Counters only ever increase across sessions
+	for teat, want := range map[string]string{"AvG": "2", "ArG": "1"} {
+		if value, _ := sample(output, models.MetricIncomplete, `teat="`+teat+`"`); value != want {
+			t.Errorf("incomplete %s = %q, want %s", teat, value, want)
+		}
+	}
+	if value, found := sample(output, models.MetricIncomplete, `teat="AvD"`); found {
+		t.Errorf("incomplete AvD = %s, want none", value)
+	}
+
+	// Historical output resets every teat counter before the first and after the last record
+	var out bytes.Buffer
+	if err := e.WriteHistoricalMetricsWithInit(&out, []*models.MilkingRecord{first, second}); err != nil {
+		t.Fatal(err)
+	}
+	for _, teat := range []string{"AvG", "ArG"} {
+		name := e.naming.TeatMetricName(first, models.MetricIncomplete, teat)
+		for _, ts := range []time.Time{first.EndTime.Add(-10 * time.Minute), second.EndTime.Add(10 * time.Minute)} {
+			if reset := fmt.Sprintf("%s 0 %d\n", name, ts.UnixMilli()); !strings.Contains(out.String(), reset) {
+				t.Errorf("historical output lacks reset %q", reset)
+			}
+		}
+	}
+}
+
+func TestTeatMetricStyle(t *testing.T) {
+	mask := int(models.LeftFront | models.RightRear)
+	r := testRecord(1, 10, time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC))
+	r.Kickoff = &mask
+
+	tests := []struct {
+		style             TeatMetricStyle
+		perTeat, combined bool
+	}{
+		{TeatStylePerTeat, true, false},
+		{TeatStyleCombined, false, true},
+		{TeatStyleBoth, true, true},
+		{"", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.style), func(t *testing.T) {
+			e := NewExporter(metrics.NewSet(), Config{Location: time.UTC, TeatMetricStyle: tt.style})
+			e.CreateMetricsFromRecords([]*models.MilkingRecord{r})
+			output := exposition(e)
+
+			for _, teat := range []string{"AvG", "ArD"} {
+				if _, found := sample(output, models.MetricKickoff, `teat="`+teat+`"`); found != tt.perTeat {
+					t.Errorf("per teat kickoff %s exposed = %t, want %t", teat, found, tt.perTeat)
+				}
+			}
+			if _, found := sample(output, models.MetricKickoffTeats, `teats="AvG,ArD"`); found != tt.combined {
+				t.Errorf("combined kickoff exposed = %t, want %t", found, tt.combined)
+			}
+		})
+	}
+
+	if _, err := ParseTeatMetricStyle("quarters"); err == nil {
+		t.Error("unknown teat metric style accepted")
+	}
+}
+
+func TestConductivitySamples(t *testing.T) {
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	low, high := 65, 70
+	conductivity := []*int{&low, nil, &high}
+
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	want := 0
+	for i, c := range conductivity {
+		r := testRecord(int64(i+1), 10, end.Add(time.Duration(i)*12*time.Hour))
+		r.Conductivity = c
+		e.CreateMetricsFromRecords([]*models.MilkingRecord{r})
+
+		// Only records with a conductivity reading are counted
+		if c != nil {
+			want++
+		}
+		if value, _ := sample(exposition(e), models.MetricConductivitySamples, `animal_number="1"`); value != fmt.Sprint(want) {
+			t.Errorf("after record %d: conductivity samples = %q, want %d", i+1, value, want)
+		}
+	}
+}
+
+func TestConnectionPoolMetrics(t *testing.T) {
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	e.CreateConnectionPoolMetrics(sql.DBStats{OpenConnections: 5, InUse: 2, Idle: 3})
+	output := exposition(e)
+
+	for metric, want := range map[string]string{
+		models.MetricDBConnectionsOpen:  "5",
+		models.MetricDBConnectionsInUse: "2",
+		models.MetricDBConnectionsIdle:  "3",
+	} {
+		if value, _ := sample(output, metric); value != want {
+			t.Errorf("%s = %q, want %s", metric, value, want)
+		}
+	}
+}
+
+func TestDurationHistogramFormat(t *testing.T) {
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	short, long := 300, 700
+	first, second := testRecord(1, 10, end), testRecord(2, 11, end.Add(12*time.Hour))
+	first.Duration, second.Duration = &short, &long
+
+	tests := []struct {
+		format HistogramFormat
+		want   map[string]string // Bucket label to cumulative count
+	}{
+		{HistogramPrometheus, map[string]string{`le="240"`: "0", `le="360"`: "1", `le="720"`: "2", `le="+Inf"`: "2"}},
+		{HistogramVMRange, map[string]string{`vmrange="2.783e+02...3.162e+02"`: "1", `vmrange="6.813e+02...7.743e+02"`: "1"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.format), func(t *testing.T) {
+			e := NewExporter(metrics.NewSet(), Config{Location: time.UTC, DurationHistogram: tt.format})
+			e.CreateMetricsFromRecords([]*models.MilkingRecord{first, second})
+			output := exposition(e)
+
+			for label, want := range tt.want {
+				if value, _ := sample(output, models.MetricMilkingDuration+"_bucket", label); value != want {
+					t.Errorf("bucket %s = %q, want %s:\n%s", label, value, want, output)
+				}
+			}
+			if value, _ := sample(output, models.MetricMilkingDuration+"_sum"); value != "1000" {
+				t.Errorf("sum = %q, want 1000", value)
+			}
+			if value, _ := sample(output, models.MetricMilkingDuration+"_count"); value != "2" {
+				t.Errorf("count = %q, want 2", value)
+			}
+		})
+	}
+}
+
+func TestHerdDaysInLactation(t *testing.T) {
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	animal := func(number string, days *int) *models.MilkingRecord {
+		r := testRecord(1, 10, end)
+		r.AnimalNumber, r.AnimalRegNo, r.DaysInLactation = number, "CH"+number, days
+		return r
+	}
+	early, late, later := 30, 150, 200
+
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	// Animals without lactation data only
+	e.CreateMetricsFromRecords([]*models.MilkingRecord{animal("1", nil)})
+	if value, found := sample(exposition(e), models.MetricHerdDaysInLactation); found {
+		t.Errorf("herd days in lactation without lactation data = %s, want none", value)
+	}
+
+	// Animals without lactation data are excluded, and the latest value of each animal counts
+	e.CreateMetricsFromRecords([]*models.MilkingRecord{animal("2", &early), animal("3", nil), animal("4", &late)})
+	if value, _ := sample(exposition(e), models.MetricHerdDaysInLactation); value != "90" {
+		t.Errorf("herd days in lactation = %q, want 90", value)
+	}
+	e.CreateMetricsFromRecords([]*models.MilkingRecord{animal("4", &later)})
+	if value, _ := sample(exposition(e), models.MetricHerdDaysInLactation); value != "115" {
+		t.Errorf("herd days in lactation = %q, want 115", value)
+	}
+}
+
+func TestSomaticCellHistogram(t *testing.T) {
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	var records []*models.MilkingRecord
+	for i, scc := range []int{50_000, 100_000, 150_000, 350_000, 800_000, 2_500_000} {
+		r := testRecord(int64(i+1), 10, end.Add(time.Duration(i)*12*time.Hour))
+		r.SomaticCellCount = &scc
+		records = append(records, r)
+	}
+	// Sessions without somatic cell count are not observed
+	records = append(records, testRecord(7, 10, end.Add(72*time.Hour)))
+
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	e.CreateMetricsFromRecords(records)
+	output := exposition(e)
+
+	// Buckets are cumulative, an upper bound being inclusive
+	for le, want := range map[string]string{"100000": "2", "200000": "3", "400000": "4", "1e+06": "5", "+Inf": "6"} {
+		if value, _ := sample(output, models.MetricSCCHistogram+"_bucket", `le="`+le+`"`); value != want {
+			t.Errorf("bucket le=%s = %q, want %s:\n%s", le, value, want, output)
+		}
+	}
+	if value, _ := sample(output, models.MetricSCCHistogram+"_count"); value != "6" {
+		t.Errorf("count = %q, want 6", value)
+	}
+}
+
+func TestNullFieldMetrics(t *testing.T) {
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	scc, conductivity := 150_000, 65
+	record := func(oid int64, scc, conductivity *int) *models.MilkingRecord {
+		r := testRecord(oid, 10, end.Add(time.Duration(oid)*time.Hour))
+		r.SomaticCellCount, r.Conductivity = scc, conductivity
+		return r
+	}
+
+	tests := []struct {
+		name              string
+		records           []*models.MilkingRecord
+		nullSCC, nullCond string
+	}{
+		{"no gaps", []*models.MilkingRecord{record(1, &scc, &conductivity)}, "0", "0"},
+		{"missing somatic cell count", []*models.MilkingRecord{record(1, nil, &conductivity)}, "1", "0"},
+		{"missing conductivity", []*models.MilkingRecord{record(1, &scc, nil)}, "0", "1"},
+		{"both missing", []*models.MilkingRecord{record(1, nil, nil)}, "1", "1"},
+		{"mixed", []*models.MilkingRecord{record(1, nil, nil), record(2, nil, &conductivity), record(3, &scc, nil), record(4, &scc, &conductivity)}, "2", "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+			e.CreateMetricsFromRecords(tt.records)
+			output := exposition(e)
+
+			if value, _ := sample(output, models.MetricNullSCC); value != tt.nullSCC {
+				t.Errorf("null somatic cell counts = %q, want %s", value, tt.nullSCC)
+			}
+			if value, _ := sample(output, models.MetricNullConductivity); value != tt.nullCond {
+				t.Errorf("null conductivities = %q, want %s", value, tt.nullCond)
+			}
+		})
+	}
+}
+
+func TestTeatMetricPrefix(t *testing.T) {
+	mask := int(models.LeftFront)
+	r := testRecord(1, 10, time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC))
+	r.Incomplete, r.Kickoff = &mask, &mask
+	r.QuarterYields = map[models.Teat]float64{models.LeftFront: 2.5}
+	r.QuarterPeakFlows = map[models.Teat]float64{models.LeftFront: 1.2}
+
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC, TeatMetricPrefix: "delpro_teat_"})
+	e.CreateMetricsFromRecords([]*models.MilkingRecord{r})
+	output := exposition(e)
+
+	teatMetrics := map[string]bool{
+		"delpro_teat_milking_incomplete_teat":                  true,
+		"delpro_teat_milking_kickoff_teat":                     true,
+		"delpro_teat_milking_incomplete_teats":                 true,
+		"delpro_teat_milking_kickoff_teats":                    true,
+		"delpro_teat_milk_quarter_yield_liters":                true,
+		"delpro_teat_milk_quarter_peak_flow_liters_per_minute": true,
+	}
+	exposed := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		name := lineMetricName(line)
+		exposed[name] = true
+		// Every other metric keeps the main prefix
+		if strings.HasPrefix(name, "delpro_teat_") != teatMetrics[name] {
+			t.Errorf("metric %s has the wrong prefix", name)
+		}
+	}
+	for name := range teatMetrics {
+		if !exposed[name] {
+			t.Errorf("teat metric %s not exposed:\n%s", name, output)
+		}
+	}
+}
+
+func TestZeroYieldLong(t *testing.T) {
+	tests := []struct {
+		name     string
+		yield    float64
+		duration *int
+		counted  bool
+	}{
+		{"below threshold", 0, intPtr(299), false},
+		{"at threshold", 0, intPtr(300), true},
+		{"above threshold", 0, intPtr(900), true},
+		{"with yield", 0.1, intPtr(900), false},
+		{"without duration", 0, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRecord(1, tt.yield, time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC))
+			r.Duration = tt.duration
+
+			e := NewExporter(metrics.NewSet(), Config{Location: time.UTC, ZeroYieldMinDuration: 5 * time.Minute})
+			e.InitializeCountersToZero(r)
+			e.CreateMetricsFromRecords([]*models.MilkingRecord{r})
+
+			want := "0"
+			if tt.counted {
+				want = "1"
+			}
+			if value, _ := sample(exposition(e), models.MetricZeroYieldLong, `animal_number="1"`); value != want {
+				t.Errorf("zero yield long sessions = %q, want %s", value, want)
+			}
+		})
+	}
+}
+
+// intPtr returns a pointer to v
+func intPtr(v int) *int {
+	return &v
+}
+
+// failingWriter fails every write after the given number of successful writes
+type failingWriter struct {
+	writes int
+}
+
+func (fw *failingWriter) Write(p []byte) (int, error) {
+	if fw.writes == 0 {
+		return 0, errors.New("connection reset")
+	}
+	fw.writes--
+	return len(p), nil
+}
+
+func TestTimestampWriterFlushError(t *testing.T) {
+	// The final line without trailing newline is only written, and fails, when flushing
+	tw := NewTimestampWriter(&failingWriter{writes: 1}, time.UnixMilli(1714543200000))
+	if _, err := io.WriteString(tw, "delpro_milk_sessions_total 3\ndelpro_milk_yield_liters 12.5"); err != nil {
+		t.Fatalf("write of the complete line failed: %v", err)
+	}
+	if err := tw.Flush(); err == nil {
+		t.Error("flush error not reported")
+	}
+
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	records := []*models.MilkingRecord{testRecord(1, 12.5, time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC))}
+	if err := e.WriteHistoricalMetrics(&failingWriter{}, records); err == nil {
+		t.Error("historical write error not reported")
+	}
+}
+
+func TestLastSessionResult(t *testing.T) {
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	leftFront := int(models.LeftFront)
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+
+	for i, result := range []string{models.SessionComplete, models.SessionKickoff, models.SessionIncomplete, models.SessionComplete} {
+		r := testRecord(int64(i+1), 10, end.Add(time.Duration(i)*12*time.Hour))
+		switch result {
+		case models.SessionKickoff:
+			r.Kickoff = &leftFront
+		case models.SessionIncomplete:
+			r.Incomplete = &leftFront
+		}
+		e.CreateMetricsFromRecords([]*models.MilkingRecord{r})
+		output := exposition(e)
+
+		// Only the series of the latest result is exposed
+		if strings.Count(output, models.MetricAnimalLastSession+"{") != 1 {
+			t.Errorf("session %d: want a single last session series:\n%s", i+1, output)
+		}
+		if value, _ := sample(output, models.MetricAnimalLastSession, `animal_number="1"`, `result="`+result+`"`); value != "1" {
+			t.Errorf("session %d: last session %s = %q, want 1", i+1, result, value)
+		}
+	}
+}
+
+func TestBreedIDLabel(t *testing.T) {
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	translated := testRecord(1, 10, end)
+	// Breeds without translation are named by their identifier
+	untranslated := testRecord(2, 11, end)
+	untranslated.AnimalNumber, untranslated.AnimalRegNo, untranslated.BreedName, untranslated.BreedID = "2", "CH2", "7", "7"
+
+	for _, enabled := range []bool{true, false} {
+		e := NewExporter(metrics.NewSet(), Config{Location: time.UTC, BreedIDLabel: enabled})
+		e.CreateMetricsFromRecords([]*models.MilkingRecord{translated, untranslated})
+		output := exposition(e)
+
+		for _, r := range []*models.MilkingRecord{translated, untranslated} {
+			labels := []string{`animal_number="` + r.AnimalNumber + `"`, `breed="` + r.BreedName + `"`}
+			if enabled {
+				labels = append(labels, `breed_id="`+r.BreedID+`"`)
+			}
+			if _, found := sample(output, models.MetricLastMilkYield, labels...); !found {
+				t.Errorf("breed id label %t: no yield of animal %s with labels %v:\n%s", enabled, r.AnimalNumber, labels, output)
+			}
+		}
+		if strings.Contains(output, "breed_id=") != enabled {
+			t.Errorf("breed id label %t, output:\n%s", enabled, output)
+		}
+	}
+}
+
+func TestTotalMilkingTime(t *testing.T) {
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	var records []*models.MilkingRecord
+	// Sessions without duration and inconsistent negative durations are not summed
+	for i, duration := range []*int{intPtr(420), nil, intPtr(380), intPtr(-60), intPtr(0)} {
+		r := testRecord(int64(i+1), 10, end.Add(time.Duration(i)*12*time.Hour))
+		r.Duration = duration
+		records = append(records, r)
+	}
+
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	e.CreateMetricsFromRecords(records)
+	if value, _ := sample(exposition(e), models.MetricTotalMilkingTime, `animal_number="1"`); value != "800" {
+		t.Errorf("total milking time = %q, want 800", value)
+	}
+
+	// Historical output resets the counter around the records
+	var out bytes.Buffer
+	if err := e.WriteHistoricalMetricsWithInit(&out, records); err != nil {
+		t.Fatal(err)
+	}
+	name := e.naming.RecordMetricName(records[0], models.MetricTotalMilkingTime)
+	for _, want := range []string{
+		fmt.Sprintf("%s 0 %d\n", name, end.Add(-10*time.Minute).UnixMilli()),
+		fmt.Sprintf("%s 800 %d\n", name, records[4].EndTime.UnixMilli()),
+		fmt.Sprintf("%s 0 %d\n", name, records[4].EndTime.Add(10*time.Minute).UnixMilli()),
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("historical output lacks %q", want)
+		}
+	}
+}
+
+func TestPrecisionWriter(t *testing.T) {
+	const input = `# HELP delpro_milk_last_yield_liters Last milk yield 1.23456
+delpro_milk_last_yield_liters{animal_name="Bella 2.345"} 12.34567
+delpro_milk_conductivity_mScm 65.55 1714543200000
+delpro_milk_last_yield_timestamp 1.7145432e+09
+delpro_milk_duration_seconds_bucket{le="+Inf"} +Inf
+`
+	tests := []struct {
+		decimals int
+		want     []string
+	}{
+		{0, []string{`delpro_milk_last_yield_liters{animal_name="Bella 2.345"} 12`, "delpro_milk_conductivity_mScm 66 1714543200000"}},
+		{1, []string{`delpro_milk_last_yield_liters{animal_name="Bella 2.345"} 12.3`, "delpro_milk_conductivity_mScm 65.6 1714543200000"}},
+		{3, []string{`delpro_milk_last_yield_liters{animal_name="Bella 2.345"} 12.346`, "delpro_milk_conductivity_mScm 65.55 1714543200000"}},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.decimals), func(t *testing.T) {
+			var out bytes.Buffer
+			pw := NewPrecisionWriter(&out, tt.decimals)
+			if _, err := io.WriteString(pw, input); err != nil {
+				t.Fatal(err)
+			}
+			if err := pw.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Comments, timestamps, labels and non-finite values are left untouched
+			want := append([]string{
+				"# HELP delpro_milk_last_yield_liters Last milk yield 1.23456",
+				"delpro_milk_last_yield_timestamp 1714543200",
+				`delpro_milk_duration_seconds_bucket{le="+Inf"} +Inf`,
+			}, tt.want...)
+			for _, line := range want {
+				if !strings.Contains(out.String(), line+"\n") {
+					t.Errorf("output lacks %q:\n%s", line, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestDeviceIncompleteRatio(t *testing.T) {
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	e.CreateDeviceUtilizationMetrics(map[string]models.DeviceUtilization{
+		"1": {Sessions: 100, IncompleteSessions: 5},
+		"2": {Sessions: 80, IncompleteSessions: 0},
+		"3": {Sessions: 4, IncompleteSessions: 3},
+		"4": {Sessions: 0, IncompleteSessions: 0},
+	})
+	output := exposition(e)
+
+	for device, want := range map[string]string{"1": "0.05", "2": "0", "3": "0.75"} {
+		if value, _ := sample(output, models.MetricDeviceIncompleteRatio, `milk_device_id="`+device+`"`); value != want {
+			t.Errorf("incomplete ratio of device %s = %q, want %s", device, value, want)
+		}
+	}
+	// The ratio is undefined without sessions
+	if value, found := sample(output, models.MetricDeviceIncompleteRatio, `milk_device_id="4"`); found {
+		t.Errorf("incomplete ratio of device without sessions = %s, want none", value)
+	}
+}
+
+func TestMissingLactation(t *testing.T) {
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	lactating := testRecord(1, 12.5, end)
+	lactation, days := 3, 120
+	lactating.LactationNumber, lactating.DaysInLactation = &lactation, &days
+	withoutLactation := testRecord(2, 10, end)
+	withoutLactation.AnimalNumber, withoutLactation.AnimalRegNo = "2", "CH2"
+
+	tests := []struct {
+		behavior         MissingLactation
+		labels           []string // Extra labels of the days in lactation series
+		lactating, other string   // Days in lactation of both animals, empty when not exposed
+	}{
+		{MissingLactationOmit, nil, "120", ""},
+		{"", nil, "120", ""},
+		{MissingLactationSentinel, nil, "120", "-1"},
+		{MissingLactationLabel, []string{`has_lactation="true"`, `has_lactation="false"`}, "120", "0"},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.behavior), func(t *testing.T) {
+			e := NewExporter(metrics.NewSet(), Config{Location: time.UTC, MissingLactation: tt.behavior})
+			e.CreateMetricsFromRecords([]*models.MilkingRecord{lactating, withoutLactation})
+			output := exposition(e)
+
+			for i, want := range []string{tt.lactating, tt.other} {
+				labels := []string{`animal_number="` + fmt.Sprint(i+1) + `"`}
+				if tt.labels != nil {
+					labels = append(labels, tt.labels[i])
+				}
+				if value, found := sample(output, models.MetricDaysInLactation, labels...); value != want || found != (want != "") {
+					t.Errorf("days in lactation of animal %d = %q, want %q", i+1, value, want)
+				}
+			}
+		})
+	}
+
+	if _, err := ParseMissingLactation("zero"); err == nil {
+		t.Error("unknown missing lactation behavior accepted")
+	}
+}
+
+func TestDeviceAverageYield(t *testing.T) {
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	session := func(oid int64, device string, yield float64) *models.MilkingRecord {
+		r := testRecord(oid, yield, end.Add(time.Duration(oid)*time.Hour))
+		r.DeviceID = device
+		return r
+	}
+
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	e.CreateMetricsFromRecords([]*models.MilkingRecord{session(1, "1", 10), session(2, "1", 12), session(3, "2", 8)})
+	e.CreateMetricsFromRecords([]*models.MilkingRecord{session(4, "1", 14), session(5, "2", 9)})
+	output := exposition(e)
+
+	// Averages run over all sessions processed so far
+	for device, want := range map[string]string{"1": "12", "2": "8.5"} {
+		if value, _ := sample(output, models.MetricDeviceAvgYield, `milk_device_id="`+device+`"`); value != want {
+			t.Errorf("average yield of device %s = %q, want %s", device, value, want)
+		}
+	}
+}
+
+func TestAnimalNumberMetric(t *testing.T) {
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	animal := func(number, regNo string) *models.MilkingRecord {
+		r := testRecord(1, 10, end)
+		r.AnimalNumber, r.AnimalRegNo = number, regNo
+		return r
+	}
+	records := []*models.MilkingRecord{animal("42", "CH42"), animal("0017", "CH17"), animal("A-12", "CH12")}
+
+	for _, enabled := range []bool{true, false} {
+		e := NewExporter(metrics.NewSet(), Config{Location: time.UTC, AnimalNumberMetric: enabled})
+		e.CreateMetricsFromRecords(records)
+		output := exposition(e)
+
+		for regNo, want := range map[string]string{"CH42": "42", "CH17": "17"} {
+			value, found := sample(output, models.MetricAnimalNumber, `animal_reg_no="`+regNo+`"`)
+			if found != enabled || (enabled && value != want) {
+				t.Errorf("enabled %t: animal number of %s = %q, want %q", enabled, regNo, value, want)
+			}
+		}
+		// Animal numbers that are not numeric are skipped
+		if value, found := sample(output, models.MetricAnimalNumber, `animal_reg_no="CH12"`); found {
+			t.Errorf("enabled %t: non-numeric animal number exposed as %s", enabled, value)
+		}
+	}
+}
+
+func TestSessionsCoverage(t *testing.T) {
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+
+	// Processed sessions accumulate across updates while the database total is replaced
+	e.CreateMetricsFromRecords([]*models.MilkingRecord{testRecord(1, 10, end), testRecord(2, 11, end.Add(time.Hour))})
+	e.SetTotalSessions(1500)
+	e.CreateMetricsFromRecords([]*models.MilkingRecord{testRecord(3, 12, end.Add(2*time.Hour))})
+	e.SetTotalSessions(1501)
+
+	output := exposition(e)
+	if value, _ := sample(output, models.MetricSessionsProcessed); value != "3" {
+		t.Errorf("sessions processed = %q, want 3", value)
+	}
+	if value, _ := sample(output, models.MetricDBTotalSessions); value != "1501" {
+		t.Errorf("database sessions = %q, want 1501", value)
+	}
+}
+
+func TestDriedOffMetrics(t *testing.T) {
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	cutoff := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	recent, old := cutoff.Add(6*time.Hour), cutoff.Add(-72*time.Hour)
+
+	e.CreateDriedOffMetrics([]models.LactatingAnimal{
+		{AnimalNumber: "1", AnimalName: "Bella", AnimalRegNo: "CH1", LastSession: &recent},
+		{AnimalNumber: "2", AnimalName: "Alma", AnimalRegNo: "CH2", LastSession: &old},
+		{AnimalNumber: "3", AnimalName: "Heidi", AnimalRegNo: "CH3"},
+	}, cutoff)
+	output := exposition(e)
+	for number, want := range map[string]string{"1": "0", "2": "1", "3": "1"} {
+		if value, _ := sample(output, models.MetricAnimalDriedOff, fmt.Sprintf("animal_number=%q", number)); value != want {
+			t.Errorf("animal %s: dried off = %q, want %s", number, value, want)
+		}
+	}
+
+	// Animal 2 calved again and animal 3 left the herd
+	e.CreateDriedOffMetrics([]models.LactatingAnimal{
+		{AnimalNumber: "1", AnimalName: "Bella", AnimalRegNo: "CH1", LastSession: &recent},
+		{AnimalNumber: "2", AnimalName: "Alma", AnimalRegNo: "CH2", LastSession: &recent},
+	}, cutoff)
+	output = exposition(e)
+	if value, _ := sample(output, models.MetricAnimalDriedOff, `animal_number="2"`); value != "0" {
+		t.Errorf("animal 2 after calving: dried off = %q, want 0", value)
+	}
+	if _, found := sample(output, models.MetricAnimalDriedOff, `animal_number="3"`); found {
+		t.Errorf("animal 3 still reported after leaving the herd:\n%s", output)
+	}
+}
+
+func TestRuntimeMetrics(t *testing.T) {
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	e.SetRuntimeMetrics()
+
+	output := exposition(e)
+	for _, metric := range []string{models.MetricExporterGoroutines, models.MetricExporterHeapBytes} {
+		value, _ := sample(output, metric)
+		if v, err := strconv.ParseFloat(value, 64); err != nil || v <= 0 {
+			t.Errorf("%s = %q, want a positive value", metric, value)
+		}
+	}
+}
+
+func TestManualIntervention(t *testing.T) {
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	none, leftFront, both := 0, int(models.LeftFront), int(models.LeftFront|models.RightRear)
+
+	records := []*models.MilkingRecord{
+		testRecord(1, 10, end),
+		testRecord(2, 11, end.Add(time.Hour)),
+		testRecord(3, 12, end.Add(2*time.Hour)),
+		testRecord(4, 13, end.Add(3*time.Hour)),
+		testRecord(5, 14, end.Add(4*time.Hour)),
+	}
+	records[1].ManualAttach = &none
+	records[2].ManualAttach = &leftFront
+	records[3].ManualAttach, records[3].DeviceID = &both, "2"
+	records[4].ManualAttach, records[4].DeviceID = &leftFront, "2"
+	e.CreateMetricsFromRecords(records)
+
+	// Sessions without manual attachment data or without manually attached teat are not counted
+	output := exposition(e)
+	for device, want := range map[string]string{"1": "1", "2": "2"} {
+		if value, _ := sample(output, models.MetricManualIntervention, fmt.Sprintf("milk_device_id=%q", device)); value != want {
+			t.Errorf("device %s: manual interventions = %q, want %s", device, value, want)
+		}
+	}
+}
+
+func TestHistoricalOutputStable(t *testing.T) {
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+
+	var records []*models.MilkingRecord
+	for i, regNo := range []string{"CH3", "CH1", "CH2", "CH1", "CH3", "CH2", "CH1"} {
+		// Two sessions of CH1 end at the same time, only their OID orders them
+		r := testRecord(int64(10-i), float64(10+i), end.Add(time.Duration(i%3)*time.Hour))
+		r.AnimalNumber, r.AnimalRegNo = strings.TrimPrefix(regNo, "CH"), regNo
+		records = append(records, r)
+	}
+
+	var want string
+	for i := range 20 {
+		shuffled := slices.Clone(records)
+		rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		var out bytes.Buffer
+		if err := e.WriteHistoricalMetrics(&out, shuffled); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			want = out.String()
+		} else if out.String() != want {
+			t.Fatalf("output differs across runs:\n%s\nfirst run:\n%s", out.String(), want)
+		}
+	}
+
+	// Animals follow each other by registration number, each with timestamps in order
+	var regNos []string
+	var last int64
+	series := regexp.MustCompile(`animal_reg_no="(CH\d)".* (\d+)$`)
+	for _, line := range strings.Split(strings.TrimSpace(want), "\n") {
+		m := series.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		timestamp, _ := strconv.ParseInt(m[2], 10, 64)
+		if len(regNos) == 0 || regNos[len(regNos)-1] != m[1] {
+			regNos, last = append(regNos, m[1]), 0
+		}
+		if timestamp < last {
+			t.Errorf("%s: timestamp %d after %d", m[1], timestamp, last)
+		}
+		last = timestamp
+	}
+	if !slices.Equal(regNos, []string{"CH1", "CH2", "CH3"}) {
+		t.Errorf("animals written in order %v, want CH1, CH2, CH3", regNos)
+	}
+}
+
+func TestLoadImbalance(t *testing.T) {
+	tests := []struct {
+		name        string
+		utilization map[string]models.DeviceUtilization
+		want        float64
+		ok          bool
+	}{
+		{"balanced", map[string]models.DeviceUtilization{"1": {Sessions: 100}, "2": {Sessions: 100}}, 0, true},
+		{"single device", map[string]models.DeviceUtilization{"1": {Sessions: 80}}, 0, true},
+		{"one idle robot", map[string]models.DeviceUtilization{"1": {Sessions: 100}, "2": {Sessions: 0}}, 1, true},
+		{"skewed", map[string]models.DeviceUtilization{"1": {Sessions: 60}, "2": {Sessions: 120}, "3": {Sessions: 120}}, math.Sqrt2 / 5, true},
+		{"no sessions", map[string]models.DeviceUtilization{"1": {}, "2": {}}, 0, false},
+		{"no devices", map[string]models.DeviceUtilization{}, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := loadImbalance(tt.utilization)
+		if ok != tt.ok || math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: imbalance = %v (%t), want %v (%t)", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	e.CreateDeviceUtilizationMetrics(map[string]models.DeviceUtilization{"1": {Sessions: 100}, "2": {Sessions: 0}})
+	if value, _ := sample(exposition(e), models.MetricDeviceLoadImbalance); value != "1" {
+		t.Errorf("load imbalance = %q, want 1", value)
+	}
+}
+
+func TestHistoricalIntegerValues(t *testing.T) {
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	r := testRecord(1, 12.5, end)
+	somaticCells := 2_450_000
+	r.SomaticCellCount = &somaticCells
+
+	var out bytes.Buffer
+	if err := e.WriteHistoricalMetrics(&out, []*models.MilkingRecord{r}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "e+") {
+		t.Errorf("output holds values in scientific notation:\n%s", out.String())
+	}
+
+	// Whole numbers are plain integers, others keep their decimals
+	for metric, want := range map[string]string{
+		models.MetricLastYieldTimestamp: fmt.Sprintf("%d %d", end.Unix(), end.UnixMilli()),
+		models.MetricSomaticCellTotal:   fmt.Sprintf("2450000 %d", end.UnixMilli()),
+		models.MetricLastMilkYield:      fmt.Sprintf("12.5 %d", end.UnixMilli()),
+	} {
+		if value, _ := sample(out.String(), metric); value != want {
+			t.Errorf("%s = %q, want %q", metric, value, want)
+		}
+	}
+}
+
+func TestNilOptionalFields(t *testing.T) {
+	end := time.Date(2024, 5, 1, 6, 0, 0, 0, time.UTC)
+	record := func(oid int64) *models.MilkingRecord {
+		return &models.MilkingRecord{OID: oid, AnimalNumber: "1", AnimalRegNo: "CH1", DeviceID: "1", Yield: 9.5, EndTime: end}
+	}
+
+	// Every optional field is nil, the metrics without value are skipped instead of panicking
+	e := NewExporter(metrics.NewSet(), Config{Location: time.UTC})
+	e.CreateMetricsFromRecords([]*models.MilkingRecord{record(1)})
+	e.CatchUpRecords([]*models.MilkingRecord{record(2)})
+	var historical bytes.Buffer
+	if err := e.WriteHistoricalMetrics(&historical, []*models.MilkingRecord{record(3)}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, output := range map[string]string{"live": exposition(e), "historical": historical.String()} {
+		if _, found := sample(output, models.MetricLastMilkYield, `animal_number="1"`); !found {
+			t.Errorf("%s: no yield of the session:\n%s", name, output)
+		}
+		for _, metric := range []string{models.MetricConductivity, models.MetricLastMilkingDuration, models.MetricIncomplete, models.MetricKickoff, models.MetricDaysInLactation} {
+			if _, found := sample(output, metric, `animal_number="1"`); found {
+				t.Errorf("%s: %s emitted without value:\n%s", name, metric, output)
+			}
+		}
+	}
+}
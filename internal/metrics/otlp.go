@@ -0,0 +1,237 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// otlpScope is the instrumentation scope and service name of pushed metrics
+const otlpScope = "delpro-exporter"
+
+// OTLP aggregation temporality of sums and histograms, Prometheus series being cumulative
+const otlpCumulative = 2
+
+// OTLPPusher pushes the metrics of a gatherer to an OTLP/HTTP endpoint, using the JSON encoding
+// Each series becomes a data point of the metric of its family, with the series labels as attributes
+type OTLPPusher struct {
+	endpoint string
+	gatherer prometheus.Gatherer
+	client   *http.Client
+	start    time.Time // Start time of cumulative data points
+}
+
+// NewOTLPPusher creates a new pusher of the metrics gathered from gatherer to endpoint, e.g. http://collector:4318/v1/metrics
+func NewOTLPPusher(endpoint string, gatherer prometheus.Gatherer) *OTLPPusher {
+	return &OTLPPusher{
+		endpoint: endpoint,
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		start:    time.Now(),
+	}
+}
+
+// Push gathers the current metrics and sends them in a single export request
+func (p *OTLPPusher) Push(ctx context.Context) error {
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+
+	body, err := json.Marshal(p.exportRequest(families, time.Now()))
+	if err != nil {
+		return fmt.Errorf("failed to encode OTLP request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create OTLP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send OTLP request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("OTLP endpoint answered %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
+
+// OTLP/JSON messages, with the 64-bit integers encoded as strings as required by the protobuf JSON mapping
+type (
+	otlpExportRequest struct {
+		ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+	}
+	otlpResourceMetrics struct {
+		Resource     otlpResource       `json:"resource"`
+		ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeMetrics struct {
+		Scope   otlpInstrumentationScope `json:"scope"`
+		Metrics []otlpMetric             `json:"metrics"`
+	}
+	otlpInstrumentationScope struct {
+		Name string `json:"name"`
+	}
+	otlpMetric struct {
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		Gauge       *otlpGauge     `json:"gauge,omitempty"`
+		Sum         *otlpSum       `json:"sum,omitempty"`
+		Histogram   *otlpHistogram `json:"histogram,omitempty"`
+	}
+	otlpGauge struct {
+		DataPoints []otlpNumberDataPoint `json:"dataPoints"`
+	}
+	otlpSum struct {
+		DataPoints             []otlpNumberDataPoint `json:"dataPoints"`
+		AggregationTemporality int                   `json:"aggregationTemporality"`
+		IsMonotonic            bool                  `json:"isMonotonic"`
+	}
+	otlpHistogram struct {
+		DataPoints             []otlpHistogramDataPoint `json:"dataPoints"`
+		AggregationTemporality int                      `json:"aggregationTemporality"`
+	}
+	otlpNumberDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		AsDouble          float64         `json:"asDouble"`
+	}
+	otlpHistogramDataPoint struct {
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		TimeUnixNano      string          `json:"timeUnixNano"`
+		Count             string          `json:"count"`
+		Sum               float64         `json:"sum"`
+		BucketCounts      []string        `json:"bucketCounts"`
+		ExplicitBounds    []float64       `json:"explicitBounds"`
+	}
+	otlpAttribute struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue string `json:"stringValue"`
+	}
+)
+
+// exportRequest converts gathered metric families to an OTLP export request
+// Counters become monotonic cumulative sums, gauges and untyped metrics gauges, and classic histograms
+// explicit bucket histograms; samples without a finite value cannot be encoded in JSON and are skipped
+func (p *OTLPPusher) exportRequest(families []*dto.MetricFamily, now time.Time) otlpExportRequest {
+	startTime := strconv.FormatInt(p.start.UnixNano(), 10)
+	timestamp := strconv.FormatInt(now.UnixNano(), 10)
+
+	metrics := make([]otlpMetric, 0, len(families))
+	for _, family := range families {
+		metric := otlpMetric{Name: family.GetName(), Description: family.GetHelp()}
+
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			sum := &otlpSum{AggregationTemporality: otlpCumulative, IsMonotonic: true}
+			for _, m := range family.GetMetric() {
+				if value := m.GetCounter().GetValue(); isFinite(value) {
+					sum.DataPoints = append(sum.DataPoints, otlpNumberDataPoint{
+						Attributes:        otlpAttributes(m),
+						StartTimeUnixNano: startTime,
+						TimeUnixNano:      timestamp,
+						AsDouble:          value,
+					})
+				}
+			}
+			metric.Sum = sum
+		case dto.MetricType_HISTOGRAM:
+			histogram := &otlpHistogram{AggregationTemporality: otlpCumulative}
+			for _, m := range family.GetMetric() {
+				histogram.DataPoints = append(histogram.DataPoints, otlpHistogramPoint(m.GetHistogram(), otlpAttributes(m), startTime, timestamp))
+			}
+			metric.Histogram = histogram
+		default:
+			gauge := &otlpGauge{}
+			for _, m := range family.GetMetric() {
+				value := m.GetGauge().GetValue()
+				if family.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+				if isFinite(value) {
+					gauge.DataPoints = append(gauge.DataPoints, otlpNumberDataPoint{
+						Attributes:   otlpAttributes(m),
+						TimeUnixNano: timestamp,
+						AsDouble:     value,
+					})
+				}
+			}
+			metric.Gauge = gauge
+		}
+
+		metrics = append(metrics, metric)
+	}
+
+	return otlpExportRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{Key: "service.name", Value: otlpAnyValue{StringValue: otlpScope}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpInstrumentationScope{Name: otlpScope},
+			Metrics: metrics,
+		}},
+	}}}
+}
+
+// otlpHistogramPoint converts a classic histogram, OTLP bucket counts being per bucket instead of cumulative
+// and including the +Inf bucket, which is implied by the sample count
+func otlpHistogramPoint(h *dto.Histogram, attributes []otlpAttribute, startTime, timestamp string) otlpHistogramDataPoint {
+	point := otlpHistogramDataPoint{
+		Attributes:        attributes,
+		StartTimeUnixNano: startTime,
+		TimeUnixNano:      timestamp,
+		Count:             strconv.FormatUint(h.GetSampleCount(), 10),
+		Sum:               h.GetSampleSum(),
+		ExplicitBounds:    []float64{},
+	}
+
+	var previous uint64
+	for _, b := range h.GetBucket() {
+		if math.IsInf(b.GetUpperBound(), 1) {
+			continue
+		}
+		point.ExplicitBounds = append(point.ExplicitBounds, b.GetUpperBound())
+		point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(b.GetCumulativeCount()-previous, 10))
+		previous = b.GetCumulativeCount()
+	}
+	point.BucketCounts = append(point.BucketCounts, strconv.FormatUint(h.GetSampleCount()-previous, 10))
+
+	return point
+}
+
+// otlpAttributes converts the labels of a series to string attributes
+func otlpAttributes(m *dto.Metric) []otlpAttribute {
+	attributes := make([]otlpAttribute, 0, len(m.GetLabel()))
+	for _, label := range m.GetLabel() {
+		attributes = append(attributes, otlpAttribute{Key: label.GetName(), Value: otlpAnyValue{StringValue: label.GetValue()}})
+	}
+	return attributes
+}
+
+// isFinite reports whether a value is neither NaN nor infinite
+func isFinite(value float64) bool {
+	return !math.IsNaN(value) && !math.IsInf(value, 0)
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// PrecisionWriter wraps an io.Writer and rounds the value of each Prometheus exposition line to a number of decimals
+type PrecisionWriter struct {
+	lineWriter
+
+	writer   io.Writer
+	decimals int
+}
+
+// NewPrecisionWriter creates a new writer rounding metric values to the given number of decimals
+func NewPrecisionWriter(w io.Writer, decimals int) *PrecisionWriter {
+	pw := &PrecisionWriter{
+		writer:   w,
+		decimals: decimals,
+	}
+	pw.transform = pw.writeLine
+	return pw
+}
+
+// writeLine rounds the value of a `name{labels} value [timestamp]` line, comment lines are forwarded as is
+func (pw *PrecisionWriter) writeLine(line string) error {
+	if strings.HasPrefix(line, "#") {
+		_, err := fmt.Fprintf(pw.writer, "%s\n", line)
+		return err
+	}
+
+	// The value follows the labels, which may contain spaces in quoted values
+	series, rest := line, ""
+	if j := strings.LastIndex(line, "}"); j != -1 {
+		series, rest = line[:j+1], line[j+1:]
+	} else if i := strings.Index(line, " "); i != -1 {
+		series, rest = line[:i], line[i:]
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) > 0 {
+		fields[0] = pw.round(fields[0])
+	}
+	_, err := fmt.Fprintf(pw.writer, "%s %s\n", series, strings.Join(fields, " "))
+	return err
+}
+
+// round rounds a formatted value, leaving values that are not finite numbers untouched
+func (pw *PrecisionWriter) round(value string) string {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsInf(v, 0) || math.IsNaN(v) {
+		return value
+	}
+	scale := math.Pow10(pw.decimals)
+	return strconv.FormatFloat(math.Round(v*scale)/scale, 'f', -1, 64)
+}
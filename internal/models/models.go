@@ -1,7 +1,9 @@
 package models
 
 import (
+	"cmp"
 	"fmt"
+	"slices"
 	"strings"
 	"time"
 )
@@ -16,6 +18,9 @@ const (
 	RightRear                   // 8
 )
 
+// AllTeats lists the teat positions in quarter order
+var AllTeats = []Teat{LeftFront, RightFront, LeftRear, RightRear}
+
 // String returns the string representation of the teat
 func (t Teat) String() string {
 	switch t {
@@ -33,90 +38,303 @@ func (t Teat) String() string {
 }
 
 const (
-	// Data format version for metric labels
-	DataFormatVersion = "0.3.0"
+	// Data format version for metric labels, bumped whenever metric names or labels change
+	// It is added to every metric through Naming when its version label is enabled, and exposed on MetricExporterInfo
+	DataFormatVersion = "0.4.0"
 
 	// Metric names
 	MetricMilkSessions          = "delpro_milk_sessions_total"
 	MetricMilkYieldTotal        = "delpro_milk_yield_liters_total"
+	MetricMinMilkYield          = "delpro_milk_min_yield_liters"
+	MetricMaxMilkYield          = "delpro_milk_max_yield_liters"
+	MetricAnimalPeakYieldTime   = "delpro_animal_peak_yield_timestamp"
 	MetricLastMilkYield         = "delpro_milk_last_yield_liters"
 	MetricLastYieldTimestamp    = "delpro_milk_last_yield_timestamp"
 	MetricConductivity          = "delpro_milk_conductivity_mScm"
+	MetricConductivitySamples   = "delpro_milk_conductivity_samples_total"
+	MetricTemperature           = "delpro_milk_temperature_celsius"
+	MetricLastTemperature       = "delpro_milk_last_temperature_celsius"
+	MetricLastTempTimestamp     = "delpro_milk_last_temperature_timestamp"
 	MetricSomaticCellTotal      = "delpro_milk_somatic_cell_total"
 	MetricLastSomaticCellTotal  = "delpro_milk_last_somatic_cell"
 	MetricLastSCCTimestamp      = "delpro_milk_last_somatic_cell_timestamp"
+	MetricSCCHistogram          = "delpro_milk_scc_histogram"
 	MetricMilkingDuration       = "delpro_milking_duration_seconds"
 	MetricLastMilkingDuration   = "delpro_last_milking_duration_seconds"
 	MetricLastDurationTimestamp = "delpro_last_milking_duration_timestamp"
+	MetricTotalMilkingTime      = "delpro_animal_total_milking_time_seconds_total"
 	MetricIncomplete            = "delpro_milking_incomplete_teat"
 	MetricKickoff               = "delpro_milking_kickoff_teat"
 	MetricIncompleteTeats       = "delpro_milking_incomplete_teats"
 	MetricKickoffTeats          = "delpro_milking_kickoff_teats"
+	MetricManualIntervention    = "delpro_milking_manual_intervention_total"
+	MetricQuarterYield          = "delpro_milk_quarter_yield_liters"
+	MetricQuarterPeakFlow       = "delpro_milk_quarter_peak_flow_liters_per_minute"
+	MetricZeroYieldLong         = "delpro_milking_zero_yield_long_total"
+	MetricAnimalLastSession     = "delpro_animal_last_session"
 	MetricDaysInLactation       = "delpro_animal_days_in_lactation"
+	MetricLactationYield        = "delpro_animal_lactation_yield_liters"
+	MetricAnimalNumber          = "delpro_animal_number"
+	MetricAnimalDriedOff        = "delpro_animal_dried_off"
+	MetricAnimalWeight          = "delpro_animal_weight_kg"
+	MetricHerdDaysInLactation   = "delpro_herd_avg_days_in_lactation"
 	MetricDeviceUtilization     = "delpro_device_utilization_sessions_per_day"
+	MetricActiveDevices         = "delpro_active_devices"
+	MetricDeviceIncompleteRatio = "delpro_device_incomplete_ratio"
+	MetricDeviceAvgYield        = "delpro_device_avg_yield_per_session_liters"
+	MetricDeviceLoadImbalance   = "delpro_device_load_imbalance"
+	MetricSessionsByHour        = "delpro_sessions_by_hour"
+	MetricExporterInfo          = "delpro_exporter_info"
+	MetricExporterConfig        = "delpro_exporter_config"
+	MetricLabelCleaned          = "delpro_label_cleaned_total"
+	MetricNullSCC               = "delpro_null_scc_total"
+	MetricNullConductivity      = "delpro_null_conductivity_total"
+	MetricDBConnected           = "delpro_db_connected"
+	MetricDBTotalSessions       = "delpro_db_total_sessions"
+	MetricDBQueryDuration       = "delpro_db_query_duration_seconds"
+	MetricDBConnectionsOpen     = "delpro_db_connections_open"
+	MetricDBConnectionsInUse    = "delpro_db_connections_in_use"
+	MetricDBConnectionsIdle     = "delpro_db_connections_idle"
+	MetricExporterStart         = "delpro_exporter_start_timestamp"
+	MetricExporterHeartbeat     = "delpro_exporter_heartbeat_timestamp"
+	MetricSessionsProcessed     = "delpro_exporter_sessions_processed"
+	MetricExporterGoroutines    = "delpro_exporter_goroutines"
+	MetricExporterHeapBytes     = "delpro_exporter_heap_bytes"
+	MetricScrapeSuccess         = "delpro_scrape_success"
+	MetricScrapeDuration        = "delpro_scrape_duration_seconds"
+	MetricLastSuccessfulScrape  = "delpro_last_successful_scrape_timestamp"
+	MetricUpdateDuration        = "delpro_exporter_update_duration_seconds"
 
 	// Query parameters
 	DefaultLookbackWindow   = 24 * time.Hour
 	HistoricalLookbackHours = 30 * 24 * time.Hour
+
+	// Delay applied to live queries so that voluntary session milk yield data is populated
+	LiveDelay = 5 * time.Minute
+)
+
+// MetricType is the Prometheus type of an exported metric
+type MetricType string
+
+const (
+	MetricTypeCounter   MetricType = "counter"
+	MetricTypeGauge     MetricType = "gauge"
+	MetricTypeHistogram MetricType = "histogram"
 )
 
+// MetricDescriptor describes an exported metric family
+type MetricDescriptor struct {
+	Name string     // Metric name without labels
+	Type MetricType // Prometheus metric type
+	Help string     // Human readable description
+}
+
+// MetricDescriptors is the registry of all metric families exported by DelPro exporter
+var MetricDescriptors = []MetricDescriptor{
+	{MetricMilkSessions, MetricTypeCounter, "Total number of milking sessions"},
+	{MetricMilkYieldTotal, MetricTypeGauge, "Cumulative milk yield in liters"},
+	{MetricMinMilkYield, MetricTypeGauge, "Lowest session milk yield processed since the exporter start in liters"},
+	{MetricMaxMilkYield, MetricTypeGauge, "Highest session milk yield processed since the exporter start in liters"},
+	{MetricAnimalPeakYieldTime, MetricTypeGauge, "Unix timestamp of the end of the highest yield session processed since the exporter start"},
+	{MetricLastMilkYield, MetricTypeGauge, "Milk yield of the last session in liters"},
+	{MetricLastYieldTimestamp, MetricTypeGauge, "Unix timestamp of the last milk yield"},
+	{MetricConductivity, MetricTypeGauge, "Average milk conductivity of the last session in mS/cm"},
+	{MetricConductivitySamples, MetricTypeCounter, "Number of sessions with a conductivity measurement"},
+	{MetricTemperature, MetricTypeGauge, "Average milk temperature of the last session in degrees Celsius"},
+	{MetricLastTemperature, MetricTypeGauge, "Milk temperature of the last session with a temperature measurement in degrees Celsius"},
+	{MetricLastTempTimestamp, MetricTypeGauge, "Unix timestamp of the last milk temperature"},
+	{MetricSomaticCellTotal, MetricTypeGauge, "Cumulative somatic cell count in cells/ml"},
+	{MetricLastSomaticCellTotal, MetricTypeGauge, "Somatic cell count of the last session in cells/ml"},
+	{MetricLastSCCTimestamp, MetricTypeGauge, "Unix timestamp of the last somatic cell count"},
+	{MetricSCCHistogram, MetricTypeHistogram, "Distribution of session somatic cell counts across the herd in cells/ml"},
+	{MetricMilkingDuration, MetricTypeHistogram, "Duration of milking sessions in seconds"},
+	{MetricLastMilkingDuration, MetricTypeGauge, "Duration of the last milking session in seconds"},
+	{MetricLastDurationTimestamp, MetricTypeGauge, "Unix timestamp of the last milking duration"},
+	{MetricTotalMilkingTime, MetricTypeCounter, "Total milking time of the animal in seconds"},
+	{MetricIncomplete, MetricTypeCounter, "Number of incomplete milkings per teat"},
+	{MetricKickoff, MetricTypeCounter, "Number of kickoffs per teat"},
+	{MetricIncompleteTeats, MetricTypeCounter, "Number of incomplete milkings per combination of teats"},
+	{MetricKickoffTeats, MetricTypeCounter, "Number of kickoffs per combination of teats"},
+	{MetricManualIntervention, MetricTypeCounter, "Number of sessions with manually attached teats per device"},
+	{MetricQuarterYield, MetricTypeGauge, "Milk yield of the last session per quarter in liters"},
+	{MetricQuarterPeakFlow, MetricTypeGauge, "Peak milk flow of the last session per quarter in liters per minute"},
+	{MetricZeroYieldLong, MetricTypeCounter, "Number of sessions without milk lasting at least the zero yield duration threshold"},
+	{MetricAnimalLastSession, MetricTypeGauge, "Outcome of the last session of an animal, always 1, carrying the result label"},
+	{MetricDaysInLactation, MetricTypeGauge, "Days since the start of the current lactation"},
+	{MetricLactationYield, MetricTypeGauge, "Total milk yield of the current lactation in liters"},
+	{MetricAnimalNumber, MetricTypeGauge, "Numeric animal number per registration number, for range queries"},
+	{MetricAnimalDriedOff, MetricTypeGauge, "Whether an animal with an open lactation had no recent session, 1 or 0"},
+	{MetricAnimalWeight, MetricTypeGauge, "Latest walk-over scale weight of an animal in kilograms"},
+	{MetricHerdDaysInLactation, MetricTypeGauge, "Average days in lactation across animals with an open lactation"},
+	{MetricDeviceUtilization, MetricTypeGauge, "Number of milking sessions per device over the last 24h"},
+	{MetricActiveDevices, MetricTypeGauge, "Number of milking devices with sessions over the last 24h"},
+	{MetricDeviceIncompleteRatio, MetricTypeGauge, "Ratio of incomplete to total sessions per device over the last 24h"},
+	{MetricDeviceLoadImbalance, MetricTypeGauge, "Coefficient of variation of the sessions per device over the last 24h, 0 when evenly balanced"},
+	{MetricDeviceAvgYield, MetricTypeGauge, "Average milk yield per session and device since the exporter start in liters"},
+	{MetricSessionsByHour, MetricTypeCounter, "Number of milking sessions per hour of day in the database timezone"},
+	{MetricExporterInfo, MetricTypeGauge, "Exporter information, always 1, carrying the data format version"},
+	{MetricExporterConfig, MetricTypeGauge, "Effective configuration, always 1, one series per flag carrying its value and source"},
+	{MetricLabelCleaned, MetricTypeCounter, "Number of label values altered by cleaning, a sign of malformed source data"},
+	{MetricNullSCC, MetricTypeCounter, "Number of processed sessions without a somatic cell count"},
+	{MetricNullConductivity, MetricTypeCounter, "Number of processed sessions without a conductivity measurement"},
+	{MetricDBConnected, MetricTypeGauge, "Whether the database connection could be established, 1 or 0"},
+	{MetricDBTotalSessions, MetricTypeGauge, "Number of milking sessions in the database"},
+	{MetricDBQueryDuration, MetricTypeHistogram, "Duration of database queries per query in seconds"},
+	{MetricDBConnectionsOpen, MetricTypeGauge, "Number of open database connections"},
+	{MetricDBConnectionsInUse, MetricTypeGauge, "Number of database connections in use"},
+	{MetricDBConnectionsIdle, MetricTypeGauge, "Number of idle database connections"},
+	{MetricExporterStart, MetricTypeGauge, "Unix timestamp of the exporter start"},
+	{MetricExporterHeartbeat, MetricTypeGauge, "Unix timestamp of the last metrics update, successful or not"},
+	{MetricSessionsProcessed, MetricTypeGauge, "Number of milking sessions processed since the exporter start"},
+	{MetricExporterGoroutines, MetricTypeGauge, "Number of goroutines of the exporter, updated on each metrics update"},
+	{MetricExporterHeapBytes, MetricTypeGauge, "Bytes of allocated heap objects of the exporter, updated on each metrics update"},
+	{MetricScrapeSuccess, MetricTypeGauge, "Whether the last database collection succeeded per collector, 1 or 0"},
+	{MetricScrapeDuration, MetricTypeGauge, "Duration of the last database collection per collector in seconds"},
+	{MetricLastSuccessfulScrape, MetricTypeGauge, "Unix timestamp of the last successful database collection per collector"},
+	{MetricUpdateDuration, MetricTypeHistogram, "Duration of live metrics updates in seconds, database queries included"},
+}
+
 // MilkingRecord represents a single milking session from the database
 type MilkingRecord struct {
 	OID              int64     // Database OID for tracking processed records
 	AnimalNumber     string    // Farm animal number
 	AnimalName       string    // Animal name
 	AnimalRegNo      string    // Official registration number
-	BreedName        string    // Breed name (translated to French)
+	BreedName        string    // Breed name (translated to the breed locale)
+	BreedID          string    // Raw breed identifier, before translation
 	DeviceID         string    // Milking device identifier
 	DestinationName  string    // Milk destination name (Tank, Drain, etc.)
 	LactationNumber  *int      // Current lactation number (optional)
 	DaysInLactation  *int      // Days since lactation start (optional)
+	LactationYield   *float64  // Total yield of the current lactation in liters (optional)
 	Yield            float64   // Milk yield in liters
 	Conductivity     *int      // Milk conductivity [mS/cm] (optional)
+	Temperature      *float64  // Average milk temperature [°C] (optional, not reported by all devices)
 	Duration         *int      // Session duration in seconds (optional)
 	SomaticCellCount *int      // Somatic cell count [cells/ml] (optional)
 	Incomplete       *int      // Incomplete milking flag (optional)
 	Kickoff          *int      // Kickoff event flag (optional)
+	ManualAttach     *int      // Manually attached teats bitfield (optional)
 	BeginTime        time.Time // Session start time
 	EndTime          time.Time // Session end time
+
+	QuarterYields    map[Teat]float64 // Per quarter yield in liters, quarters without data are absent
+	QuarterPeakFlows map[Teat]float64 // Per quarter peak flow in liters per minute, quarters without data are absent
+
+	CleanedLabels []string // Labels whose value was altered by cleaning, a sign of malformed source data
 }
 
-// LabelStr returns formatted Prometheus labels for the record
-func (r *MilkingRecord) LabelStr() string {
+// Naming holds the options shaping metric names and labels
+type Naming struct {
+	VersionLabel     bool   // Add the data_format_version label to every metric, otherwise only exposed by the info metric
+	BreedIDLabel     bool   // Add the raw breed identifier as breed_id label to animal metrics
+	TeatMetricPrefix string // Replaces MetricPrefix on teat metric names, MetricPrefix when empty
+}
+
+// withVersionLabel appends the data_format_version label to labels when enabled
+func (n Naming) withVersionLabel(labels string) string {
+	if !n.VersionLabel {
+		return labels
+	}
+	version := fmt.Sprintf("data_format_version=%q", DataFormatVersion)
+	if labels == "" {
+		return version
+	}
+	return labels + "," + version
+}
+
+// LabeledMetricName returns a fully qualified metric name with the given labels
+func (n Naming) LabeledMetricName(metric, labels string) string {
+	labels = n.withVersionLabel(labels)
+	if labels == "" {
+		return metric
+	}
+	return fmt.Sprintf("%s{%s}", metric, labels)
+}
+
+// RecordLabels returns formatted Prometheus labels for the record
+func (n Naming) RecordLabels(r *MilkingRecord) string {
 	lactationNum := "unknown"
 	if r.LactationNumber != nil {
 		lactationNum = fmt.Sprintf("%d", *r.LactationNumber)
 	}
-	return fmt.Sprintf("animal_number=%q,animal_name=%q,animal_reg_no=%q,breed=%q,milk_device_id=%q,destination=%q,lactation=%q,data_format_version=%q",
-		r.AnimalNumber, r.AnimalName, r.AnimalRegNo, r.BreedName, r.DeviceID, r.DestinationName, lactationNum, DataFormatVersion)
+	breedID := ""
+	if n.BreedIDLabel {
+		breedID = fmt.Sprintf(",breed_id=%q", r.BreedID)
+	}
+	return n.withVersionLabel(fmt.Sprintf("animal_number=%q,animal_name=%q,animal_reg_no=%q,breed=%q%s,milk_device_id=%q,destination=%q,lactation=%q",
+		r.AnimalNumber, r.AnimalName, r.AnimalRegNo, r.BreedName, breedID, r.DeviceID, r.DestinationName, lactationNum))
+}
+
+// RecordMetricName returns a fully qualified metric name with the labels of the record
+func (n Naming) RecordMetricName(r *MilkingRecord, metric string) string {
+	return fmt.Sprintf("%s{%s}", metric, n.RecordLabels(r))
+}
+
+// MetricPrefix is the prefix shared by all metric names
+const MetricPrefix = "delpro_"
+
+// teatMetrics lists the metric families named with the teat metric prefix
+var teatMetrics = []string{
+	MetricIncomplete, MetricKickoff, MetricIncompleteTeats, MetricKickoffTeats, MetricQuarterYield, MetricQuarterPeakFlow,
+}
+
+// TeatPrefix returns the prefix of teat metric names
+func (n Naming) TeatPrefix() string {
+	return cmp.Or(n.TeatMetricPrefix, MetricPrefix)
+}
+
+// teatMetricFamily returns the teat metric name with the teat metric prefix applied
+func (n Naming) teatMetricFamily(metric string) string {
+	return n.TeatPrefix() + strings.TrimPrefix(metric, MetricPrefix)
+}
+
+// MetricFamily returns the exposed name of a metric family, with the teat metric prefix applied to teat metrics
+func (n Naming) MetricFamily(metric string) string {
+	if slices.Contains(teatMetrics, metric) {
+		return n.teatMetricFamily(metric)
+	}
+	return metric
 }
 
-// TeatLabelStr returns formatted Prometheus labels for teat-specific metrics
-func (r *MilkingRecord) TeatLabelStr(teat string) string {
-	return fmt.Sprintf("%s,teat=%q", r.LabelStr(), teat)
+// TeatMetricName returns a fully qualified teat metric name with the labels of the record
+func (n Naming) TeatMetricName(r *MilkingRecord, metric, teat string) string {
+	return fmt.Sprintf("%s{%s,teat=%q}", n.teatMetricFamily(metric), n.RecordLabels(r), teat)
 }
 
-// TeatsLabelStr returns formatted Prometheus labels for concatenated teats metrics
-func (r *MilkingRecord) TeatsLabelStr(teats string) string {
-	return fmt.Sprintf("%s,teats=%q", r.LabelStr(), teats)
+// TeatsMetricName returns a fully qualified concatenated teats metric name with the labels of the record
+func (n Naming) TeatsMetricName(r *MilkingRecord, metric, teats string) string {
+	return fmt.Sprintf("%s{%s,teats=%q}", n.teatMetricFamily(metric), n.RecordLabels(r), teats)
 }
 
-// TeatMetricName returns a fully qualified teat metric name with labels
-func (r *MilkingRecord) TeatMetricName(metric, teat string) string {
-	return fmt.Sprintf("%s{%s}", metric, r.TeatLabelStr(teat))
+// Session results of the last session metric
+const (
+	SessionComplete   = "complete"
+	SessionIncomplete = "incomplete"
+	SessionKickoff    = "kickoff"
+)
+
+// SessionResult classifies the record outcome from its teat bitfields, a kickoff taking precedence over an incomplete milking
+func (r *MilkingRecord) SessionResult() string {
+	switch {
+	case r.Kickoff != nil && *r.Kickoff != 0:
+		return SessionKickoff
+	case r.Incomplete != nil && *r.Incomplete != 0:
+		return SessionIncomplete
+	default:
+		return SessionComplete
+	}
 }
 
-// TeatsMetricName returns a fully qualified concatenated teats metric name with labels
-func (r *MilkingRecord) TeatsMetricName(metric, teats string) string {
-	return fmt.Sprintf("%s{%s}", metric, r.TeatsLabelStr(teats))
+// ManualIntervention reports whether at least one teat of the session was attached manually
+func (r *MilkingRecord) ManualIntervention() bool {
+	return r.ManualAttach != nil && *r.ManualAttach != 0
 }
 
 // GetAffectedTeats returns a slice of teat names based on bitfield value
 func GetAffectedTeats(bitfield int) []string {
 	var teats []string
-	allTeats := []Teat{LeftFront, RightFront, LeftRear, RightRear}
-
-	for _, teat := range allTeats {
+	for _, teat := range AllTeats {
 		if bitfield&int(teat) != 0 {
 			teats = append(teats, teat.String())
 		}
@@ -144,7 +362,82 @@ func (r *MilkingRecord) String() string {
 		r.OID, r.AnimalNumber, r.AnimalName, r.AnimalRegNo, r.Yield, sccStr)
 }
 
-// MetricName returns a fully qualified metric name with labels
-func (r *MilkingRecord) MetricName(metric string) string {
-	return fmt.Sprintf("%s{%s}", metric, r.LabelStr())
+// Configuration setting sources
+const (
+	ConfigSourceFlag    = "flag"
+	ConfigSourceEnv     = "env"
+	ConfigSourceFile    = "file"
+	ConfigSourceDefault = "default"
+)
+
+// ConfigSetting is the effective value of a configuration flag and where it comes from
+type ConfigSetting struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"` // One of flag, env, file or default
+}
+
+// DeviceUtilization holds the session counts of a milking device over the utilization window
+type DeviceUtilization struct {
+	Sessions           int // Number of milking sessions
+	IncompleteSessions int // Number of sessions with at least one incomplete teat
+}
+
+// LactatingAnimal is an animal with an open lactation
+type LactatingAnimal struct {
+	AnimalNumber string     // Farm animal number
+	AnimalName   string     // Animal name
+	AnimalRegNo  string     // Official registration number
+	LastSession  *time.Time // End of the last session of the lactation, nil when there was none
+}
+
+// DriedOff reports whether the animal had no session of its open lactation since cutoff
+func (a LactatingAnimal) DriedOff(cutoff time.Time) bool {
+	return a.LastSession == nil || a.LastSession.Before(cutoff)
+}
+
+// WeightRecord is the latest walk-over scale weighing of an animal
+type WeightRecord struct {
+	AnimalNumber string    // Farm animal number
+	AnimalName   string    // Animal name
+	AnimalRegNo  string    // Official registration number
+	Weight       float64   // Weight in kilograms
+	Time         time.Time // Weighing time
+}
+
+// HerdStats holds aggregate herd statistics over a time window
+type HerdStats struct {
+	Start            time.Time `json:"start"`
+	End              time.Time `json:"end"`
+	TotalYield       float64   `json:"total_yield_liters"`
+	Sessions         int       `json:"sessions"`
+	ActiveAnimals    int       `json:"active_animals"`
+	AvgSomaticCell   *float64  `json:"avg_somatic_cell_count"` // nil when no session has a somatic cell count
+	SomaticCellCount int       `json:"somatic_cell_samples"`
+}
+
+// NewHerdStats computes aggregate herd statistics from the milking records of a time window
+func NewHerdStats(records []*MilkingRecord, start, end time.Time) *HerdStats {
+	stats := &HerdStats{Start: start, End: end}
+	animals := make(map[string]bool)
+	var sccSum float64
+
+	for _, r := range records {
+		stats.TotalYield += r.Yield
+		stats.Sessions++
+		animals[r.AnimalNumber] = true
+
+		if r.SomaticCellCount != nil {
+			sccSum += float64(*r.SomaticCellCount)
+			stats.SomaticCellCount++
+		}
+	}
+
+	stats.ActiveAnimals = len(animals)
+	if stats.SomaticCellCount > 0 {
+		avg := sccSum / float64(stats.SomaticCellCount)
+		stats.AvgSomaticCell = &avg
+	}
+
+	return stats
 }
@@ -0,0 +1,55 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewHerdStats(t *testing.T) {
+	start, end := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)
+	low, high := 150_000, 250_000
+	records := []*MilkingRecord{
+		{AnimalNumber: "1", Yield: 12.5, SomaticCellCount: &low},
+		{AnimalNumber: "1", Yield: 10},
+		{AnimalNumber: "2", Yield: 8.25, SomaticCellCount: &high},
+		{AnimalNumber: "3", Yield: 0},
+	}
+
+	stats := NewHerdStats(records, start, end)
+	if stats.TotalYield != 30.75 || stats.Sessions != 4 || stats.ActiveAnimals != 3 {
+		t.Errorf("total yield %v, sessions %d, active animals %d, want 30.75, 4 and 3", stats.TotalYield, stats.Sessions, stats.ActiveAnimals)
+	}
+	// Sessions without somatic cell count are left out of the average
+	if stats.AvgSomaticCell == nil || *stats.AvgSomaticCell != 200_000 || stats.SomaticCellCount != 2 {
+		t.Errorf("average somatic cell count %v over %d samples, want 200000 over 2", stats.AvgSomaticCell, stats.SomaticCellCount)
+	}
+	if !stats.Start.Equal(start) || !stats.End.Equal(end) {
+		t.Errorf("window [%v, %v), want [%v, %v)", stats.Start, stats.End, start, end)
+	}
+
+	empty := NewHerdStats(nil, start, end)
+	if empty.Sessions != 0 || empty.ActiveAnimals != 0 || empty.AvgSomaticCell != nil {
+		t.Errorf("empty stats = %+v, want no sessions nor average", empty)
+	}
+}
+
+func TestSessionResult(t *testing.T) {
+	none, leftFront := 0, int(LeftFront)
+	tests := []struct {
+		name                string
+		incomplete, kickoff *int
+		want                string
+	}{
+		{"no teat data", nil, nil, SessionComplete},
+		{"no flagged teat", &none, &none, SessionComplete},
+		{"incomplete", &leftFront, &none, SessionIncomplete},
+		{"kickoff", nil, &leftFront, SessionKickoff},
+		{"kickoff and incomplete", &leftFront, &leftFront, SessionKickoff},
+	}
+	for _, tt := range tests {
+		r := &MilkingRecord{Incomplete: tt.incomplete, Kickoff: tt.kickoff}
+		if got := r.SessionResult(); got != tt.want {
+			t.Errorf("%s: result = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,16 +1,27 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
+	"math/rand/v2"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime/debug"
+	"syscall"
 	"time"
 
+	"github.com/clementnuss/delpro-exporter/internal/dashboard"
+	"github.com/clementnuss/delpro-exporter/internal/database"
 	"github.com/clementnuss/delpro-exporter/internal/exporter"
+	delprometrics "github.com/clementnuss/delpro-exporter/internal/metrics"
+	"github.com/clementnuss/delpro-exporter/internal/models"
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/peterbourgon/ff/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
@@ -21,18 +32,69 @@ func main() {
 	fs := flag.NewFlagSet("delpro-exporter", flag.ExitOnError)
 
 	// Define flags on the custom flag set
+	fs.String("config", "", "Config file of `flag value` lines, environment variables and command line flags taking precedence")
 	listenAddr := fs.String("listen-address", ":9090", "Address to listen on for web interface and telemetry")
 	dbHost := fs.String("db-host", "localhost", "Database host")
 	dbPort := fs.String("db-port", "1433", "Database port")
 	dbName := fs.String("db-name", "DDM", "Database name")
 	dbUser := fs.String("db-user", "sa", "Database user")
+	dbEncrypt := fs.String("db-encrypt", database.EncryptDisable, "Database connection encryption: disable, true or strict")
+	dbAppName := fs.String("db-app-name", database.DefaultAppName, "Application name of the database sessions, identifying the exporter in SQL Server DMVs")
+	dbExtraParams := fs.String("db-extra-params", "", "Semicolon separated key=value parameters appended to the database connection string, e.g. 'packet size=4096;app name=delpro'")
+	dbTrustServerCertificate := fs.Bool("db-trust-server-certificate", false, "Accept self-signed database server certificates when encryption is enabled")
+	dbConnectRetries := fs.Int("db-connect-retries", database.DefaultConnectRetries, "Database connection attempts before giving up until the next metrics update")
+	dbConnectBackoff := fs.Duration("db-connect-backoff", database.DefaultConnectBackoff, "Wait between database connection attempts, growing linearly with each attempt")
 	lastOID := fs.Int64("last-oid", 0, "Override last processed OID (if larger than current value)")
 	dbTimezone := fs.String("db-timezone", "Europe/Zurich", "Database timezone location for time offset calculations")
+	outputTimezone := fs.String("output-timezone", "", "Timezone of date-only time parameters and hour of day metrics (defaults to the database timezone)")
+	deviceFilter := fs.Int64("device-filter", 0, "Only collect sessions from this milking device (0 collects all devices)")
+	versionLabel := fs.Bool("data-format-version-label", true, "Add the data_format_version label to all metrics (always exposed on delpro_exporter_info)")
+	breedIDLabel := fs.Bool("breed-id-label", false, "Add the raw breed identifier as breed_id label to animal metrics")
+	isolatedSet := fs.Bool("isolated-metrics-set", false, "Keep live metrics in a set owned by the exporter instead of the global default set")
+	teatMetricPrefix := fs.String("teat-metric-prefix", models.MetricPrefix, "Prefix of teat metric names, replacing the delpro_ prefix (e.g. delpro_teat_)")
+	teatMetricStyle := fs.String("teat-metric-style", "both", "Teat metrics to emit: teat (per teat), teats (per combination of teats) or both")
+	excludeCurrentHour := fs.Bool("utilization-exclude-current-hour", false, "Exclude the in-progress hour from device utilization")
+	extraFilter := fs.String("extra-filter", "", "Additional comma separated `field operator number` conditions on milking records (fields: animal_number, device, yield, duration)")
+	excludeAnimals := fs.String("exclude-animals", "", "Comma separated animal numbers or ranges left out of all metrics (e.g. 9000-9999,42)")
+	includeAnimals := fs.String("include-animals", "", "Comma separated animal numbers or ranges, restricting metrics to these animals (excluded animals are still left out)")
+	lookbackWindow := fs.Duration("lookback-window", models.DefaultLookbackWindow, "Time window of live database queries")
+	historicalLookback := fs.Duration("historical-lookback", models.HistoricalLookbackHours, "Default time range of historical requests without start parameter")
+	driedOffAfter := fs.Duration("dried-off-after", 0, "Flag animals with an open lactation but no session for this duration in delpro_animal_dried_off (0 disables)")
+	historicalRetries := fs.Int("historical-retries", 1, "Retries of failed historical queries before answering with an error")
+	historicalRetryBackoff := fs.Duration("historical-retry-backoff", time.Second, "Wait before the first historical query retry, growing linearly")
+	staleAnimalAfter := fs.Duration("stale-animal-after", 0, "Remove the series of animals without session for this duration, e.g. sold or dried-off animals (0 keeps them forever)")
+	collectWeight := fs.Bool("collect-weight", false, "Expose walk-over scale weights in delpro_animal_weight_kg when the database has them")
+	historicalMaxRange := fs.Duration("historical-max-range", 0, "Maximum time range of historical requests (0 means unlimited)")
+	disableHistoricalGzip := fs.Bool("disable-historical-gzip", false, "Send uncompressed /historical-metrics responses even when the client accepts gzip or zstd")
+	recoverOIDFromDB := fs.Bool("recover-oid-from-db", false, "Advance the last processed OID to the highest OID in the database at startup, skipping unprocessed records")
+	perDeviceWatermark := fs.Bool("per-device-watermark", false, "Track the last processed OID of each milking device, allowing per-device reprocessing")
+	scrapeInterval := fs.Duration("scrape-interval", 30*time.Second, "Interval between background database polls")
+	collectOnScrape := fs.Bool("collect-on-scrape", false, "Collect metrics when /metrics is scraped instead of polling the database every scrape interval")
+	minCollectInterval := fs.Duration("min-collect-interval", exporter.DefaultMinCollectInterval, "Minimum interval between scrape-time collections, scrapes in between reuse the previous result")
+	webAuthUser := fs.String("web-auth-user", "", "User required by HTTP basic auth on all endpoints but /config, which is disabled when empty")
+	webAuthPasswordFile := fs.String("web-auth-password-file", "", "File holding the HTTP basic auth password of --web-auth-user")
+	webTLSCert := fs.String("web-tls-cert", "", "TLS certificate file, serving HTTPS together with --web-tls-key")
+	webTLSKey := fs.String("web-tls-key", "", "TLS private key file of --web-tls-cert")
+	configToken := fs.String("config-token", "", "Bearer token required by the /config endpoint, which is disabled when empty")
+	enableCatchUp := fs.Bool("enable-catchup", false, "Expose POST /catchup, adding records the live metrics never counted to the live counters")
+	debugEndpoints := fs.Bool("debug-endpoints", false, "Expose debugging endpoints such as /debug/queries")
+	durationHistogram := fs.String("duration-histogram", "vmrange", "Duration histogram buckets (milking, update and query durations): vmrange (VictoriaMetrics) or prometheus (classic le buckets)")
+	metricsBackend := fs.String("metrics-backend", string(delprometrics.BackendVictoriaMetrics), "Library serving /metrics: victoriametrics or prometheus (client_golang registry, implies prometheus histograms)")
+	otlpEndpoint := fs.String("otlp-endpoint", "", "OTLP/HTTP metrics endpoint to push metrics to after each update, e.g. http://collector:4318/v1/metrics (implies prometheus histograms)")
+	missingLactation := fs.String("missing-lactation", "omit", "Days in lactation of animals without an open lactation: omit, sentinel (-1) or label (has_lactation label)")
+	zeroYieldMinDuration := fs.Duration("zero-yield-min-duration", 5*time.Minute, "Minimum duration of a session without milk to count it as a failed milking")
+	valuePrecision := fs.Int("value-precision", -1, "Round emitted metric values to this number of decimals (negative keeps full precision)")
+	sourceLabel := fs.Bool("source-label", false, "Add a source label (live or historical) to series of /metrics and /historical-metrics")
+	animalNumberMetric := fs.Bool("animal-number-metric", false, "Expose numeric animal numbers as values of delpro_animal_number, labeled by registration number")
+	breedLocale := fs.String("breed-locale", database.DefaultBreedLocale, "Language of breed names: fr, de, en (DelPro names) or any locale of --breed-translations")
+	breedTranslations := fs.String("breed-translations", "", "JSON file of breed name translations per locale, completing the built-in ones")
+	animalNumberWidth := fs.Int("animal-number-width", database.DefaultNumberWidth, "VARCHAR width used when casting animal numbers")
 
 	// Parse configuration with ff (supports flags, environment variables, and config file)
 	err := ff.Parse(fs, os.Args[1:],
-		ff.WithEnvVarPrefix("DELPRO"),
+		ff.WithEnvVarPrefix(envVarPrefix),
 		ff.WithConfigFileFlag("config"),
+		ff.WithConfigFileParser(ff.PlainParser),
 	)
 	if err != nil {
 		log.Fatal("Error parsing configuration:", err)
@@ -49,30 +111,250 @@ func main() {
 		log.Fatal("Invalid database timezone:", err)
 	}
 
-	delproExporter := exporter.NewDelProExporter(*dbHost, *dbPort, *dbName, *dbUser, dbPassword, dbLocation)
-	defer delproExporter.Close()
+	// Presentation timezone, queries keep using the database timezone
+	outputLocation := dbLocation
+	if *outputTimezone != "" {
+		outputLocation, err = time.LoadLocation(*outputTimezone)
+		if err != nil {
+			log.Fatal("Invalid output timezone:", err)
+		}
+	}
+
+	encryptMode, err := database.ParseEncrypt(*dbEncrypt)
+	if err != nil {
+		log.Fatal("Invalid database encryption:", err)
+	}
+
+	extraParams, err := database.ParseExtraParams(*dbExtraParams)
+	if err != nil {
+		log.Fatal("Invalid database connection parameters:", err)
+	}
+
+	breedNames, err := database.LoadBreedTranslations(*breedLocale, *breedTranslations)
+	if err != nil {
+		log.Fatal("Invalid breed translations:", err)
+	}
+
+	extraFilters, err := database.ParseFilters(*extraFilter)
+	if err != nil {
+		log.Fatal("Invalid extra filter:", err)
+	}
+
+	excludedAnimals, err := database.ParseAnimalRanges(*excludeAnimals)
+	if err != nil {
+		log.Fatal("Invalid excluded animals:", err)
+	}
+
+	includedAnimals, err := database.ParseAnimalRanges(*includeAnimals)
+	if err != nil {
+		log.Fatal("Invalid included animals:", err)
+	}
+
+	teatStyle, err := delprometrics.ParseTeatMetricStyle(*teatMetricStyle)
+	if err != nil {
+		log.Fatal("Invalid teat metric style:", err)
+	}
+
+	histogramFormat, err := delprometrics.ParseHistogramFormat(*durationHistogram)
+	if err != nil {
+		log.Fatal("Invalid duration histogram format:", err)
+	}
+
+	backend, err := delprometrics.ParseBackend(*metricsBackend)
+	if err != nil {
+		log.Fatal("Invalid metrics backend:", err)
+	}
+	// Prometheus registries have no equivalent of vmrange buckets
+	if backend == delprometrics.BackendPrometheus && histogramFormat != delprometrics.HistogramPrometheus {
+		log.Printf("Using prometheus duration histograms with the prometheus metrics backend")
+		histogramFormat = delprometrics.HistogramPrometheus
+	}
+	// OTLP explicit bucket histograms are converted from classic Prometheus histograms
+	if *otlpEndpoint != "" && histogramFormat != delprometrics.HistogramPrometheus {
+		log.Printf("Using prometheus duration histograms with the OTLP endpoint")
+		histogramFormat = delprometrics.HistogramPrometheus
+	}
+
+	lactationBehavior, err := delprometrics.ParseMissingLactation(*missingLactation)
+	if err != nil {
+		log.Fatal("Invalid missing lactation behavior:", err)
+	}
+
+	var webPassword string
+	if (*webAuthUser == "") != (*webAuthPasswordFile == "") {
+		log.Fatal("Invalid web auth: --web-auth-user and --web-auth-password-file must be set together")
+	}
+	if *webAuthPasswordFile != "" {
+		webPassword, err = loadWebPassword(*webAuthPasswordFile)
+		if err != nil {
+			log.Fatal("Invalid web auth:", err)
+		}
+	}
+
+	if (*webTLSCert == "") != (*webTLSKey == "") {
+		log.Fatal("Invalid web TLS: --web-tls-cert and --web-tls-key must be set together")
+	}
+
+	if *scrapeInterval <= 0 {
+		log.Fatal("Invalid scrape interval: must be positive, got ", *scrapeInterval)
+	}
+
+	if *lookbackWindow <= 0 || *historicalLookback <= 0 {
+		log.Fatal("Invalid lookback window: must be positive")
+	}
+
+	settings := configSettings(fs, os.Args[1:])
+
+	delproExporter := exporter.NewDelProExporter(exporter.Config{
+		Database: database.Config{
+			Host:         *dbHost,
+			Port:         *dbPort,
+			Name:         *dbName,
+			User:         *dbUser,
+			Password:     dbPassword,
+			Location:     dbLocation,
+			DeviceFilter: *deviceFilter,
+			NumberWidth:  *animalNumberWidth,
+			ExtraFilters: extraFilters,
+
+			Encrypt:                encryptMode,
+			TrustServerCertificate: *dbTrustServerCertificate,
+
+			AppName:     *dbAppName,
+			ExtraParams: extraParams,
+
+			ConnectRetries: *dbConnectRetries,
+			ConnectBackoff: *dbConnectBackoff,
+
+			ExcludeCurrentHour: *excludeCurrentHour,
+			ExcludeAnimals:     excludedAnimals,
+			IncludeAnimals:     includedAnimals,
+
+			BreedTranslations: breedNames,
+		},
+		IsolatedSet:        *isolatedSet,
+		HistoricalMaxRange: *historicalMaxRange,
+		LookbackWindow:     *lookbackWindow,
+		HistoricalLookback: *historicalLookback,
+		DriedOffAfter:      *driedOffAfter,
+		StaleAnimalAfter:   *staleAnimalAfter,
+		CollectWeight:      *collectWeight,
+		PerDeviceWatermark: *perDeviceWatermark,
+		RecoverOIDFromDB:   *recoverOIDFromDB,
+		OutputLocation:     outputLocation,
+		CollectOnScrape:    *collectOnScrape,
+		MinCollectInterval: *minCollectInterval,
+		ValuePrecision:     *valuePrecision,
+		SourceLabel:        *sourceLabel,
+		Settings:           settings,
+
+		DisableHistoricalGzip: *disableHistoricalGzip,
+
+		HistoricalRetries:      *historicalRetries,
+		HistoricalRetryBackoff: *historicalRetryBackoff,
+
+		OTLPEndpoint: *otlpEndpoint,
+
+		Metrics: delprometrics.Config{
+			Location:          outputLocation,
+			TeatMetricStyle:   teatStyle,
+			DurationHistogram: histogramFormat,
+
+			ZeroYieldMinDuration: *zeroYieldMinDuration,
+			MissingLactation:     lactationBehavior,
+			AnimalNumberMetric:   *animalNumberMetric,
+
+			VersionLabel:     *versionLabel,
+			BreedIDLabel:     *breedIDLabel,
+			TeatMetricPrefix: *teatMetricPrefix,
+		},
+	})
 
 	// Override last OID if specified and larger than current value
 	if *lastOID > 0 {
 		delproExporter.SetLastOID(*lastOID)
 	}
 
-	go func() {
-		for {
-			delproExporter.UpdateMetrics()
-			time.Sleep(30 * time.Second)
-		}
-	}()
+	// Stop on SIGINT/SIGTERM, letting in-flight updates finish so that the last OID is persisted
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
-		delproExporter.WritePrometheus(w, false)
-	})
+	// In collect-on-scrape mode, metrics are updated by the /metrics handler
+	updateLoopDone := make(chan struct{})
+	if *collectOnScrape {
+		close(updateLoopDone)
+	} else {
+		go func() {
+			defer close(updateLoopDone)
+			runUpdateLoop(ctx, delproExporter, *scrapeInterval)
+		}()
+	}
+
+	if backend == delprometrics.BackendPrometheus {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(delproExporter.Collector())
+		http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{ErrorLog: log.Default()}))
+	} else {
+		http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+			delproExporter.WriteCurrentMetrics(r, w)
+		})
+	}
 
 	http.HandleFunc("/historical-metrics", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
 		delproExporter.WriteHistoricalMetrics(r, w)
 	})
 
+	http.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		delproExporter.WriteStats(r, w)
+	})
+
+	if *enableCatchUp {
+		http.HandleFunc("/catchup", func(w http.ResponseWriter, r *http.Request) {
+			delproExporter.HandleCatchUp(r, w)
+		})
+	}
+
+	http.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if !delproExporter.Ready() {
+			http.Error(w, "waiting for first successful metrics update", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
+	http.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+		if err := delproExporter.Ping(ctx); err != nil {
+			http.Error(w, "database unreachable: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+
+	if *debugEndpoints {
+		http.HandleFunc("/debug/queries", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			delproExporter.WriteQueries(w)
+		})
+	}
+
+	if *configToken != "" {
+		http.HandleFunc("/config", handleConfig(settings, *configToken))
+	}
+
+	http.HandleFunc("/grafana-dashboard.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := dashboard.Write(w, delproExporter.Naming()); err != nil {
+			log.Printf("Error writing Grafana dashboard: %v", err)
+		}
+	})
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
 			<head><title>DelPro Exporter</title></head>
@@ -80,12 +362,77 @@ func main() {
 			<h1>DelPro Exporter</h1>
 			<p><a href="/metrics">Current Metrics</a></p>
 			<p><a href="/historical-metrics">Historical Metrics with Timestamps</a></p>
+			<p><a href="/stats">Herd Statistics</a></p>
+			<p><a href="/grafana-dashboard.json">Grafana Dashboard</a></p>
 			</body>
 			</html>`))
 	})
 
-	log.Printf("Starting DelPro exporter on %s", *listenAddr)
-	log.Fatal(http.ListenAndServe(*listenAddr, nil))
+	var handler http.Handler = http.DefaultServeMux
+	if *webAuthUser != "" {
+		handler = basicAuth(handler, *webAuthUser, webPassword, authExemptPaths(*configToken != ""))
+	}
+
+	server := &http.Server{Addr: *listenAddr, Handler: handler}
+	go func() {
+		var err error
+		if *webTLSCert != "" {
+			log.Printf("Starting DelPro exporter on %s with TLS", *listenAddr)
+			err = server.ListenAndServeTLS(*webTLSCert, *webTLSKey)
+		} else {
+			log.Printf("Starting DelPro exporter on %s", *listenAddr)
+			err = server.ListenAndServe()
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	log.Printf("Shutting down, waiting for in-flight requests and metrics updates")
+
+	// Scrape triggered updates run within requests, so stop serving before waiting for the update loop
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down HTTP server: %v", err)
+	}
+	<-updateLoopDone
+
+	if err := delproExporter.Close(); err != nil {
+		log.Printf("Error closing database connection: %v", err)
+	}
+	log.Printf("DelPro exporter stopped")
+}
+
+// shutdownTimeout bounds the wait for in-flight requests on shutdown
+const shutdownTimeout = 30 * time.Second
+
+// runUpdateLoop updates metrics at startup, then at the given interval until ctx is canceled
+// The first tick is delayed by a random fraction of the interval, so that replicas restarted together do not all
+// query the database at the same time
+// An update in progress when ctx is canceled runs to completion
+func runUpdateLoop(ctx context.Context, e *exporter.DelProExporter, interval time.Duration) {
+	e.UpdateMetrics()
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(rand.N(interval)):
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		e.UpdateMetrics()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
 
 // printVersionInfo prints build information including git commit/tag
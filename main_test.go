@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/clementnuss/delpro-exporter/internal/database"
+	"github.com/clementnuss/delpro-exporter/internal/exporter"
+)
+
+// unreachableExporter returns an exporter whose database connection attempts fail right away
+func unreachableExporter(t *testing.T) *exporter.DelProExporter {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	listener.Close()
+
+	return exporter.NewDelProExporter(exporter.Config{
+		Database:    database.Config{Host: "127.0.0.1", Port: port, ConnectRetries: 1, ConnectBackoff: time.Millisecond},
+		IsolatedSet: true,
+	})
+}
+
+func TestUpdateLoopStopsOnCancel(t *testing.T) {
+	e := unreachableExporter(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runUpdateLoop(ctx, e, time.Hour)
+	}()
+
+	// The loop waits for the first tick long after the initial update, cancellation must not wait for it
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("update loop still running after the context was canceled")
+	}
+	if err := e.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateLoopPollsAtInterval(t *testing.T) {
+	e := unreachableExporter(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	runUpdateLoop(ctx, e, 50*time.Millisecond)
+
+	// The initial update, then one per tick after a first tick delayed by at most one interval
+	rec := httptest.NewRecorder()
+	e.WriteCurrentMetrics(httptest.NewRequest("GET", "/metrics", nil), rec)
+	m := regexp.MustCompile(`(?m)^delpro_exporter_update_duration_seconds_count (\d+)$`).FindStringSubmatch(rec.Body.String())
+	if m == nil {
+		t.Fatalf("no update duration in output:\n%s", rec.Body.String())
+	}
+	if updates, _ := strconv.Atoi(m[1]); updates < 5 || updates > 11 {
+		t.Errorf("%d updates in 500ms with a 50ms interval, want between 5 and 11", updates)
+	}
+}
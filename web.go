@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// loadWebPassword reads the basic auth password from a file, ignoring the trailing newline
+func loadWebPassword(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read web auth password: %w", err)
+	}
+	password := strings.TrimRight(string(data), "\r\n")
+	if password == "" {
+		return "", errors.New("web auth password file is empty")
+	}
+	return password, nil
+}
+
+// probePaths are the health endpoints polled by Kubernetes probes, which cannot send credentials
+var probePaths = []string{"/ready", "/healthz", "/readyz"}
+
+// authExemptPaths returns the paths served without basic auth: the probes, and /config when its handler is registered
+// as it has its own bearer token
+func authExemptPaths(configEnabled bool) []string {
+	if configEnabled {
+		return append(slices.Clone(probePaths), "/config")
+	}
+	return probePaths
+}
+
+// basicAuth requires HTTP basic auth credentials on every request but those of the exempt paths
+func basicAuth(next http.Handler, user, password string, exempt []string) http.Handler {
+	// Comparing hashes keeps the comparison constant time whatever the length of the provided values
+	userHash := sha256.Sum256([]byte(user))
+	passwordHash := sha256.Sum256([]byte(password))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(exempt, r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		providedUser, providedPassword, ok := r.BasicAuth()
+		providedUserHash := sha256.Sum256([]byte(providedUser))
+		providedPasswordHash := sha256.Sum256([]byte(providedPassword))
+		userMatch := subtle.ConstantTimeCompare(providedUserHash[:], userHash[:])
+		passwordMatch := subtle.ConstantTimeCompare(providedPasswordHash[:], passwordHash[:])
+		if !ok || userMatch&passwordMatch != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="delpro-exporter", charset="UTF-8"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestBasicAuthExemptPaths(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name   string
+		exempt []string
+		path   string
+		auth   bool
+		want   int
+	}{
+		{"metrics without credentials", authExemptPaths(false), "/metrics", false, http.StatusUnauthorized},
+		{"metrics with credentials", authExemptPaths(false), "/metrics", true, http.StatusOK},
+		{"readiness probe", authExemptPaths(false), "/ready", false, http.StatusOK},
+		{"liveness probe", authExemptPaths(false), "/healthz", false, http.StatusOK},
+		{"kubernetes readiness probe", authExemptPaths(false), "/readyz", false, http.StatusOK},
+		{"config without token", authExemptPaths(false), "/config", false, http.StatusUnauthorized},
+		{"config with token", authExemptPaths(true), "/config", false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.auth {
+				req.SetBasicAuth("prometheus", "secret")
+			}
+			rec := httptest.NewRecorder()
+			basicAuth(ok, "prometheus", "secret", tt.exempt).ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestBasicAuthCredentials(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handler := basicAuth(ok, "prometheus", "secret", authExemptPaths(false))
+	tests := []struct {
+		name           string
+		user, password string
+		want           int
+	}{
+		{"valid", "prometheus", "secret", http.StatusOK},
+		{"wrong password", "prometheus", "secret2", http.StatusUnauthorized},
+		{"wrong user", "grafana", "secret", http.StatusUnauthorized},
+		{"password prefix", "prometheus", "sec", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/historical-metrics", nil)
+		req.SetBasicAuth(tt.user, tt.password)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.want)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate challenge", tt.name)
+		}
+	}
+}
+
+func TestLoadWebPassword(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		content string
+		want    string
+		ok      bool
+	}{
+		{"secret\n", "secret", true},
+		{"secret\r\n", "secret", true},
+		{" spaced secret ", " spaced secret ", true},
+		{"\n", "", false},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		password, err := loadWebPassword(path)
+		if (err == nil) != tt.ok || password != tt.want {
+			t.Errorf("password file %q: password = %q (%v), want %q", tt.content, password, err, tt.want)
+		}
+	}
+	if _, err := loadWebPassword(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing password file accepted")
+	}
+}